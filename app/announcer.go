@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAnnounceInterval is used when a tracker sends no interval.
+	defaultAnnounceInterval = 30 * time.Minute
+	// minAnnounceInterval guards against trackers asking for absurdly
+	// frequent announces.
+	minAnnounceInterval = 30 * time.Second
+	// announceRetry and maxAnnounceRetry bound the back-off after failures.
+	announceRetry    = 15 * time.Second
+	maxAnnounceRetry = 30 * time.Minute
+	// announceTimeout bounds a single tracker's announce, so that a dead
+	// tracker does not hold up the ones after it.
+	announceTimeout = time.Minute
+)
+
+// swarmStats is what an announcer needs to know about the torrent it
+// announces.
+type swarmStats interface {
+	Stats() (uploaded, downloaded, left int64)
+	Done() <-chan struct{}
+}
+
+// announcer keeps a torrent announced to its trackers for as long as it
+// runs: it sends started on first contact with each tracker, re-announces
+// on the tracker's interval, sends completed once the download finishes
+// and stopped when it is shut down.
+type announcer struct {
+	tiers    *trackerTiers
+	infoHash [20]byte
+	port     uint16 // where we accept peers
+	stats    swarmStats
+	peers    chan<- Peer
+
+	started       map[string]bool // trackers that have been sent started
+	current       string          // tracker that answered the last announce
+	sentCompleted bool
+}
+
+func newAnnouncer(tiers *trackerTiers, infoHash [20]byte, port uint16, stats swarmStats, peers chan<- Peer) *announcer {
+	return &announcer{
+		tiers:    tiers,
+		infoHash: infoHash,
+		port:     port,
+		stats:    stats,
+		peers:    peers,
+		started:  map[string]bool{},
+	}
+}
+
+func (a *announcer) request(event AnnounceEvent) AnnounceRequest {
+	uploaded, downloaded, left := a.stats.Stats()
+	req := AnnounceRequest{
+		InfoHash:   a.infoHash,
+		Port:       a.port,
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Left:       left,
+		Event:      event,
+		Key:        sessionKey,
+		PeerID:     localPeerID,
+	}
+	return req
+}
+
+// announce contacts the trackers tier by tier, sending started instead of
+// event to any tracker not contacted before.
+func (a *announcer) announce(ctx context.Context, event AnnounceEvent) (AnnounceResponse, error) {
+	var res AnnounceResponse
+	err := a.tiers.try(func(trackerURL string) error {
+		tracker, err := getTracker(trackerURL)
+		if err != nil {
+			return err
+		}
+		req := a.request(event)
+		if !a.started[trackerURL] && event != EventStopped {
+			req.Event = EventStarted
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, announceTimeout)
+		defer cancel()
+		res, err = tracker.Announce(attemptCtx, req)
+		if err != nil {
+			return err
+		}
+		a.started[trackerURL] = true
+		a.current = trackerURL
+		if res.Warning != "" {
+			fmt.Fprintf(os.Stderr, "Tracker warning from %s: %s\n", trackerURL, res.Warning)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// run announces until ctx is cancelled, then sends stopped to the tracker
+// in use and returns. Discovered peers are sent on the peers channel.
+func (a *announcer) run(ctx context.Context) {
+	failures := 0
+	completed := a.stats.Done()
+	event := EventNone
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			a.stop()
+			return
+		case <-completed:
+			completed = nil
+			event = EventCompleted
+		case <-timer.C:
+		}
+
+		res, err := a.announce(ctx, event)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			delay := min(announceRetry<<failures, maxAnnounceRetry)
+			// stop doubling once the cap is reached, before the shift
+			// overflows
+			if delay < maxAnnounceRetry {
+				failures++
+			}
+			fmt.Fprintf(os.Stderr, "Announce failed, retrying in %v: %v\n", delay, err)
+			resetTimer(timer, delay)
+			continue
+		}
+		failures = 0
+		if event == EventCompleted {
+			a.sentCompleted = true
+		}
+		event = EventNone
+
+		for _, peer := range res.Peers {
+			select {
+			case a.peers <- peer:
+			case <-ctx.Done():
+			}
+		}
+		resetTimer(timer, announceInterval(res))
+	}
+}
+
+// stop tells the current tracker we are leaving the swarm, reporting the
+// download as completed first if that has not happened yet. It runs after
+// the main context is cancelled, so it gets a short deadline of its own.
+func (a *announcer) stop() {
+	if a.current == "" {
+		return
+	}
+	tracker, err := getTracker(a.current)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	select {
+	case <-a.stats.Done():
+		if !a.sentCompleted {
+			tracker.Announce(ctx, a.request(EventCompleted))
+		}
+	default:
+	}
+	tracker.Announce(ctx, a.request(EventStopped))
+}
+
+// startAnnouncers runs an announcer for each set of tiers, announcing the
+// port we accept peers on. The returned function shuts them down and waits
+// until they have sent stopped.
+func startAnnouncers(ctx context.Context, tierSets []*trackerTiers, infoHash [20]byte, port uint16, stats swarmStats, peers chan<- Peer) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, tiers := range tierSets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			newAnnouncer(tiers, infoHash, port, stats, peers).run(ctx)
+		}()
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+func announceInterval(res AnnounceResponse) time.Duration {
+	interval := res.Interval
+	if interval <= 0 {
+		interval = defaultAnnounceInterval
+	}
+	return max(interval, res.MinInterval, minAnnounceInterval)
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	t.Stop()
+	select {
+	case <-t.C:
+	default:
+	}
+	t.Reset(d)
+}
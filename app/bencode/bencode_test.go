@@ -0,0 +1,320 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBytesErrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		want error
+	}{
+		{"", ErrUnexpectedEOF},
+		{"i", ErrUnexpectedEOF},
+		{"i12", ErrUnexpectedEOF},
+		{"ie", ErrInvalidInteger},
+		{"i-e", ErrInvalidInteger},
+		{"i1x2e", ErrInvalidInteger},
+		{"i9223372036854775808e", ErrInvalidInteger},
+		{"i-0e", ErrNegativeZero},
+		{"i03e", ErrLeadingZero},
+		{"01:a", ErrLeadingZero},
+		{"99999999999999999999:a", ErrInvalidLength},
+		{"5:abc", ErrUnexpectedEOF},
+		{"-1:a", ErrUnexpectedByte},
+		{"x", ErrUnexpectedByte},
+		{"l", ErrUnexpectedEOF},
+		{"li1e", ErrUnexpectedEOF},
+		{"d", ErrUnexpectedEOF},
+		{"d1:ae", ErrUnexpectedByte},
+		{"di1ei2ee", ErrUnexpectedByte},
+		{strings.Repeat("l", 10000), ErrTooDeep},
+	}
+	for _, tt := range tests {
+		_, _, err := DecodeBytes([]byte(tt.in))
+		if !errors.Is(err, tt.want) {
+			t.Errorf("DecodeBytes(%.20q) error = %v, want %v", tt.in, err, tt.want)
+		}
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("DecodeBytes(%.20q) error %T is not a *SyntaxError", tt.in, err)
+		}
+	}
+}
+
+// Every proper prefix of a valid value must fail cleanly.
+func TestDecodeBytesTruncated(t *testing.T) {
+	valid := "d8:announce4:http4:infod5:filesld6:lengthi10e4:pathl1:beee" +
+		"4:name1:a12:piece lengthi16384eee"
+	if _, n, err := DecodeBytes([]byte(valid)); err != nil || n != len(valid) {
+		t.Fatalf("DecodeBytes(valid) = %d, %v", n, err)
+	}
+	for i := 0; i < len(valid); i++ {
+		if _, _, err := DecodeBytes([]byte(valid[:i])); err == nil {
+			t.Errorf("DecodeBytes(%q) succeeded", valid[:i])
+		}
+	}
+}
+
+func TestCheckCanonicalErrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		want error
+	}{
+		{"d1:b0:1:a0:e", ErrUnsortedKeys},
+		{"d1:a0:1:a0:e", ErrDuplicateKey},
+		{"i1ei2e", ErrUnexpectedByte},
+	}
+	for _, tt := range tests {
+		if err := CheckCanonical([]byte(tt.in)); !errors.Is(err, tt.want) {
+			t.Errorf("CheckCanonical(%q) error = %v, want %v", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var s struct {
+		A int `bencode:"a"`
+	}
+	var u uint8
+	var arr [2]int
+	tests := []struct {
+		name string
+		in   string
+		v    any
+		want any // pointer to the expected error type
+	}{
+		{"nil", "i1e", nil, new(*InvalidUnmarshalError)},
+		{"non-pointer", "i1e", s, new(*InvalidUnmarshalError)},
+		{"string into int field", "d1:a1:xe", &s, new(*UnmarshalTypeError)},
+		{"uint8 overflow", "i300e", &u, new(*UnmarshalTypeError)},
+		{"negative uint", "i-1e", &u, new(*UnmarshalTypeError)},
+		{"array too short", "li1ei2ei3ee", &arr, new(*UnmarshalTypeError)},
+		{"list into struct", "le", &s, new(*UnmarshalTypeError)},
+		{"truncated", "d1:ai1e", &s, new(*SyntaxError)},
+	}
+	for _, tt := range tests {
+		err := Unmarshal([]byte(tt.in), tt.v)
+		if err == nil || !errors.As(err, tt.want) {
+			t.Errorf("%s: Unmarshal(%q) error = %v (%T)", tt.name, tt.in, err, err)
+		}
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+		want any // pointer to the expected error type, or nil for any error
+	}{
+		{"nil", nil, new(*UnsupportedValueError)},
+		{"channel", make(chan int), new(*UnsupportedTypeError)},
+		{"int keys", map[int]int{1: 1}, new(*UnsupportedTypeError)},
+		{"float", 1.5, new(*UnsupportedTypeError)},
+		{"nil pointer", (*int)(nil), new(*UnsupportedValueError)},
+		{"nil in list", []any{nil}, new(*UnsupportedValueError)},
+		{"nil map value", map[string]*int{"a": nil}, new(*UnsupportedValueError)},
+		{"nil Marshaler in list", []Marshaler{nil}, new(*UnsupportedValueError)},
+		{"nil RawMessage pointer", []*RawMessage{nil}, new(*UnsupportedValueError)},
+		{"invalid RawMessage", RawMessage("i1"), nil},
+		{"RawMessage with trailing data", RawMessage("i1ei2e"), nil},
+	}
+	for _, tt := range tests {
+		_, err := Marshal(tt.v)
+		if err == nil || (tt.want != nil && !errors.As(err, tt.want)) {
+			t.Errorf("%s: Marshal error = %v (%T)", tt.name, err, err)
+		}
+	}
+}
+
+type testFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+	MD5    []byte   `bencode:"md5sum,omitempty"`
+}
+
+type testCommon struct {
+	Name    string `bencode:"name"`
+	Private bool   `bencode:"private,omitempty"`
+}
+
+// testInfo is declared out of key order, so the encoder has to sort it.
+type testInfo struct {
+	testCommon
+	PieceLength int64            `bencode:"piece length"`
+	Pieces      []byte           `bencode:"pieces"`
+	Files       []testFile       `bencode:"files"`
+	Meta        map[string]int64 `bencode:"meta"`
+	Hash        [4]byte          `bencode:"hash"`
+	Comment     string           `bencode:"comment,omitempty"`
+	Skipped     string           `bencode:"-"`
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	files := []testFile{
+		{Length: 1 << 40, Path: []string{"a", "b"}},
+		{Length: 0, Path: []string{"c"}, MD5: []byte("xyz")},
+	}
+	tests := []struct {
+		name string
+		v    testInfo
+		want string
+	}{
+		{
+			"empty fields omitted",
+			testInfo{
+				testCommon:  testCommon{Name: "t"},
+				PieceLength: 16384,
+				Pieces:      []byte{0, 1, 0xff},
+				Files:       files,
+				Meta:        map[string]int64{"z": -1, "a": 2},
+				Hash:        [4]byte{'a', 'b', 'c', 'd'},
+			},
+			"d5:filesld6:lengthi1099511627776e4:pathl1:a1:beed6:lengthi0e6:md5sum3:xyz4:pathl1:ceee" +
+				"4:hash4:abcd4:metad1:ai2e1:zi-1ee4:name1:t12:piece lengthi16384e6:pieces3:\x00\x01\xffe",
+		},
+		{
+			"omitempty fields set",
+			testInfo{
+				testCommon:  testCommon{Name: "t", Private: true},
+				PieceLength: 1,
+				Pieces:      []byte{},
+				Files:       []testFile{},
+				Meta:        map[string]int64{},
+				Comment:     "hi",
+			},
+			"d7:comment2:hi5:filesle4:hash4:\x00\x00\x00\x004:metade4:name1:t12:piece lengthi1e6:pieces0:7:privatei1ee",
+		},
+	}
+	for _, tt := range tests {
+		data, err := Marshal(tt.v)
+		if err != nil {
+			t.Fatalf("%s: Marshal: %v", tt.name, err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s: Marshal = %q, want %q", tt.name, data, tt.want)
+		}
+		var got testInfo
+		if err := Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: Unmarshal: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.v) {
+			t.Errorf("%s: round trip = %+v, want %+v", tt.name, got, tt.v)
+		}
+	}
+}
+
+func TestUnmarshalSkipsUnknownKeys(t *testing.T) {
+	var got testCommon
+	if err := Unmarshal([]byte("d5:extrali1ee4:name1:x5:otherd1:ai1eee"), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != (testCommon{Name: "x"}) {
+		t.Errorf("Unmarshal = %+v", got)
+	}
+}
+
+// A RawMessage keeps the exact bytes of its value, even when they are not
+// canonical, and marshals them back unchanged.
+func TestRawMessageRoundTrip(t *testing.T) {
+	const in = "d4:infod1:bi1e1:a0:e4:name1:xe"
+	var v struct {
+		Info RawMessage `bencode:"info"`
+		Name string     `bencode:"name"`
+	}
+	if err := Unmarshal([]byte(in), &v); err != nil {
+		t.Fatal(err)
+	}
+	if string(v.Info) != "d1:bi1e1:a0:e" {
+		t.Errorf("Info = %q, want the original bytes", v.Info)
+	}
+	out, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != in {
+		t.Errorf("Marshal = %q, want %q", out, in)
+	}
+}
+
+// Dictionary keys come out sorted by their raw bytes, whatever the map
+// order or struct field order.
+func TestMarshalCanonical(t *testing.T) {
+	type fields struct {
+		B     int  `bencode:"b"`
+		Upper int  `bencode:"B"`
+		AB    int  `bencode:"ab"`
+		A     int  `bencode:"a"`
+		Nil   *int `bencode:"nil"`
+	}
+	tests := []struct {
+		name string
+		v    any
+		want string
+	}{
+		{"map", map[string]int{"b": 1, "B": 2, "ab": 3, "a": 4, "": 5}, "d0:i5e1:Bi2e1:ai4e2:abi3e1:bi1ee"},
+		{"struct", fields{B: 1, Upper: 2, AB: 3, A: 4}, "d1:Bi2e1:ai4e2:abi3e1:bi1ee"},
+		{"nested", map[string]any{"z": map[string]int{"y": 1, "x": 2}, "a": []int{2, 1}}, "d1:ali2ei1ee1:zd1:xi2e1:yi1eee"},
+	}
+	for _, tt := range tests {
+		for _, strict := range []bool{false, true} {
+			var buf bytes.Buffer
+			enc := NewEncoder(&buf)
+			enc.SetStrict(strict)
+			if err := enc.Encode(tt.v); err != nil {
+				t.Fatalf("%s: Encode: %v", tt.name, err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("%s: Encode = %q, want %q", tt.name, buf.String(), tt.want)
+			}
+			if err := CheckCanonical(buf.Bytes()); err != nil {
+				t.Errorf("%s: output not canonical: %v", tt.name, err)
+			}
+		}
+	}
+}
+
+type conflictA struct {
+	X int `bencode:"x"`
+}
+
+type conflictB struct {
+	X int `bencode:"x"`
+}
+
+// conflicts has two fields for key x at the same depth.
+type conflicts struct {
+	conflictA
+	conflictB
+	Y int `bencode:"y"`
+}
+
+func TestEncoderStrict(t *testing.T) {
+	tests := []struct {
+		name  string
+		v     any
+		loose string // output without strict mode
+		want  error  // error in strict mode
+	}{
+		{"unsorted RawMessage", RawMessage("d1:b0:1:a0:e"), "d1:b0:1:a0:e", ErrUnsortedKeys},
+		{"duplicate key in RawMessage", RawMessage("d1:a0:1:a0:e"), "d1:a0:1:a0:e", ErrDuplicateKey},
+		{"nested unsorted RawMessage", []RawMessage{RawMessage("ld1:bi1e1:ai1eee")}, "lld1:bi1e1:ai1eeee", ErrUnsortedKeys},
+		{"conflicting struct fields", conflicts{Y: 1}, "d1:yi1ee", ErrDuplicateKey},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf).Encode(tt.v); err != nil || buf.String() != tt.loose {
+			t.Errorf("%s: Encode = %q, %v, want %q", tt.name, buf.String(), err, tt.loose)
+		}
+		enc := NewEncoder(io.Discard)
+		enc.SetStrict(true)
+		if err := enc.Encode(tt.v); !errors.Is(err, tt.want) {
+			t.Errorf("%s: strict Encode error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
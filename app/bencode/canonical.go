@@ -0,0 +1,86 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnsortedKeys = errors.New("dictionary keys not in sorted order")
+	ErrDuplicateKey = errors.New("duplicate dictionary key")
+)
+
+// CheckCanonical reports whether data holds exactly one value in canonical
+// form, i.e. one that re-encodes to the same bytes. It returns a
+// *SyntaxError wrapping ErrUnsortedKeys or ErrDuplicateKey for the first
+// dictionary that breaks the ordering rules, or the error that decoding
+// data would produce.
+func CheckCanonical(data []byte) error {
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.checkValue(); err != nil {
+		return err
+	}
+	if int(d.off) != len(data) {
+		return d.syntaxError(fmt.Errorf("%w: trailing data after top-level value", ErrUnexpectedByte))
+	}
+	return nil
+}
+
+func (d *Decoder) checkValue() error {
+	c, err := d.peekByte()
+	if err != nil {
+		return err
+	}
+	switch c {
+	case 'l':
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+		for {
+			c, err := d.peekByte()
+			if err != nil {
+				return err
+			}
+			if c == 'e' {
+				d.readByte()
+				return nil
+			}
+			if err := d.checkValue(); err != nil {
+				return err
+			}
+		}
+	case 'd':
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+		var prev string
+		first := true
+		for {
+			keyOff := d.off
+			key, done, err := d.dictKey()
+			if err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+			if !first {
+				switch {
+				case key == prev:
+					return &SyntaxError{Offset: keyOff, Err: fmt.Errorf("%w %q", ErrDuplicateKey, key)}
+				case key < prev:
+					return &SyntaxError{Offset: keyOff, Err: fmt.Errorf("%w: %q after %q", ErrUnsortedKeys, key, prev)}
+				}
+			}
+			prev, first = key, false
+			if err := d.checkValue(); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = d.value()
+	return err
+}
@@ -0,0 +1,379 @@
+// Package bencode implements decoding and encoding of bencoded data as used
+// by .torrent files, tracker responses and the peer extension protocol.
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+var (
+	ErrUnexpectedEOF  = errors.New("unexpected end of input")
+	ErrInvalidLength  = errors.New("invalid string length prefix")
+	ErrLeadingZero    = errors.New("leading zero in number")
+	ErrNegativeZero   = errors.New("negative zero integer")
+	ErrInvalidInteger = errors.New("invalid integer")
+	ErrUnexpectedByte = errors.New("unexpected byte")
+	ErrTooDeep        = errors.New("nesting too deep")
+)
+
+// maxDepth bounds how deeply lists and dictionaries may nest, so hostile
+// input cannot exhaust the stack.
+const maxDepth = 512
+
+// directReadLimit is the largest string that is allocated up front; longer
+// strings grow their buffer as data actually arrives, so a bogus length
+// prefix cannot force a huge allocation.
+const directReadLimit = 64 * 1024
+
+// A SyntaxError describes malformed bencoded input and the byte offset at
+// which it was detected.
+type SyntaxError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %v at offset %d", e.Err, e.Offset)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+type byteScanReader interface {
+	io.Reader
+	io.ByteScanner
+}
+
+// A Decoder reads and decodes bencoded values from an input stream.
+//
+// If the underlying reader does not implement io.ByteScanner it is wrapped
+// in a bufio.Reader, in which case the Decoder may read past the end of the
+// value it returns.
+type Decoder struct {
+	r     byteScanReader
+	off   int64
+	depth int
+
+	// raw accumulates input bytes while recording is positive, so the
+	// exact encoding of a value can be handed to an Unmarshaler.
+	raw       []byte
+	recording int
+}
+
+// NewDecoder returns a new decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(byteScanReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// InputOffset returns the number of bytes consumed so far.
+func (d *Decoder) InputOffset() int64 {
+	return d.off
+}
+
+// Decode reads the next bencoded value and stores it in the value pointed
+// to by v, following the rules of Unmarshal. It returns io.EOF if the input
+// ends before a value starts.
+func (d *Decoder) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+	if _, err := d.peekByte(); err != nil {
+		if errors.Is(err, ErrUnexpectedEOF) {
+			return io.EOF
+		}
+		return err
+	}
+	return d.decodeInto(rv.Elem())
+}
+
+// DecodeBytes decodes the first bencoded value in data and returns it along
+// with the number of bytes it occupied. Byte strings decode to string,
+// integers to int, lists to []any and dictionaries to map[string]any.
+func DecodeBytes(data []byte) (any, int, error) {
+	d := NewDecoder(bytes.NewReader(data))
+	v, err := d.value()
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, int(d.off), nil
+}
+
+func (d *Decoder) syntaxError(err error) error {
+	return &SyntaxError{Offset: d.off, Err: err}
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			return 0, d.syntaxError(ErrUnexpectedEOF)
+		}
+		return 0, err
+	}
+	d.off++
+	if d.recording > 0 {
+		d.raw = append(d.raw, b)
+	}
+	return b, nil
+}
+
+func (d *Decoder) peekByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			return 0, d.syntaxError(ErrUnexpectedEOF)
+		}
+		return 0, err
+	}
+	if err := d.r.UnreadByte(); err != nil {
+		return 0, err
+	}
+	return b, nil
+}
+
+func (d *Decoder) value() (any, error) {
+	c, err := d.peekByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c >= '0' && c <= '9':
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		return string(s), nil
+	case c == 'i':
+		n, err := d.readInt()
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxInt || n < math.MinInt {
+			return nil, d.syntaxError(ErrInvalidInteger)
+		}
+		return int(n), nil
+	case c == 'l':
+		return d.list()
+	case c == 'd':
+		return d.dict()
+	}
+	return nil, d.syntaxError(fmt.Errorf("%w %q", ErrUnexpectedByte, c))
+}
+
+func (d *Decoder) list() ([]any, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	list := []any{}
+	for {
+		c, err := d.peekByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == 'e' {
+			d.readByte()
+			return list, nil
+		}
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+}
+
+func (d *Decoder) dict() (map[string]any, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	dict := map[string]any{}
+	for {
+		key, done, err := d.dictKey()
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return dict, nil
+		}
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		dict[key] = v
+	}
+}
+
+// dictKey reads the next dictionary key, or the terminating 'e' in which
+// case done is true.
+func (d *Decoder) dictKey() (key string, done bool, err error) {
+	c, err := d.peekByte()
+	if err != nil {
+		return "", false, err
+	}
+	if c == 'e' {
+		d.readByte()
+		return "", true, nil
+	}
+	if c < '0' || c > '9' {
+		return "", false, d.syntaxError(fmt.Errorf("%w %q: dictionary key must be a string", ErrUnexpectedByte, c))
+	}
+	s, err := d.readString()
+	if err != nil {
+		return "", false, err
+	}
+	return string(s), false, nil
+}
+
+// enter consumes the opening byte of a list or dictionary.
+func (d *Decoder) enter() error {
+	if d.depth >= maxDepth {
+		return d.syntaxError(ErrTooDeep)
+	}
+	d.depth++
+	_, err := d.readByte()
+	return err
+}
+
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+// readString reads a <length>:<bytes> byte string.
+func (d *Decoder) readString() ([]byte, error) {
+	start := d.off
+	var n int64
+	digits := 0
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == ':' {
+			break
+		}
+		if c < '0' || c > '9' {
+			return nil, &SyntaxError{Offset: d.off - 1, Err: fmt.Errorf("%w: unexpected byte %q", ErrInvalidLength, c)}
+		}
+		if digits == 1 && n == 0 {
+			return nil, &SyntaxError{Offset: start, Err: ErrLeadingZero}
+		}
+		if n > (math.MaxInt64-9)/10 {
+			return nil, &SyntaxError{Offset: start, Err: ErrInvalidLength}
+		}
+		n = n*10 + int64(c-'0')
+		digits++
+	}
+	if digits == 0 {
+		return nil, &SyntaxError{Offset: start, Err: ErrInvalidLength}
+	}
+
+	if n <= directReadLimit {
+		buf := make([]byte, n)
+		read, err := io.ReadFull(d.r, buf)
+		d.off += int64(read)
+		if err != nil {
+			return nil, d.readError(err)
+		}
+		d.record(buf)
+		return buf, nil
+	}
+	var buf bytes.Buffer
+	read, err := io.CopyN(&buf, d.r, n)
+	d.off += read
+	if err != nil {
+		return nil, d.readError(err)
+	}
+	d.record(buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+func (d *Decoder) record(b []byte) {
+	if d.recording > 0 {
+		d.raw = append(d.raw, b...)
+	}
+}
+
+func (d *Decoder) readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return d.syntaxError(ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// readInt reads an i<digits>e integer.
+func (d *Decoder) readInt() (int64, error) {
+	start := d.off
+	if _, err := d.readByte(); err != nil {
+		return 0, err
+	}
+	neg := false
+	c, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	if c == '-' {
+		neg = true
+		if c, err = d.readByte(); err != nil {
+			return 0, err
+		}
+	}
+	if c < '0' || c > '9' {
+		return 0, &SyntaxError{Offset: d.off - 1, Err: fmt.Errorf("%w: unexpected byte %q", ErrInvalidInteger, c)}
+	}
+	if c == '0' {
+		next, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if next != 'e' {
+			return 0, &SyntaxError{Offset: start, Err: ErrLeadingZero}
+		}
+		if neg {
+			return 0, &SyntaxError{Offset: start, Err: ErrNegativeZero}
+		}
+		return 0, nil
+	}
+
+	// Accumulate as a negative number so math.MinInt64 is representable.
+	var n int64 = -int64(c - '0')
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if c == 'e' {
+			break
+		}
+		if c < '0' || c > '9' {
+			return 0, &SyntaxError{Offset: d.off - 1, Err: fmt.Errorf("%w: unexpected byte %q", ErrInvalidInteger, c)}
+		}
+		digit := int64(c - '0')
+		if n < (math.MinInt64+digit)/10 {
+			return 0, &SyntaxError{Offset: start, Err: fmt.Errorf("%w: out of range", ErrInvalidInteger)}
+		}
+		n = n*10 - digit
+	}
+	if !neg {
+		if n == math.MinInt64 {
+			return 0, &SyntaxError{Offset: start, Err: fmt.Errorf("%w: out of range", ErrInvalidInteger)}
+		}
+		n = -n
+	}
+	return n, nil
+}
@@ -0,0 +1,224 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// An UnsupportedTypeError is returned by Marshal when attempting to encode
+// a value of a type bencode cannot represent.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "bencode: unsupported type: " + e.Type.String()
+}
+
+// An UnsupportedValueError is returned by Marshal when attempting to encode
+// a value that has no bencoded form, such as a nil pointer.
+type UnsupportedValueError struct {
+	Str string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "bencode: unsupported value: " + e.Str
+}
+
+var marshalerType = reflect.TypeFor[Marshaler]()
+
+// An Encoder writes bencoded values to an output stream.
+type Encoder struct {
+	w      *bufio.Writer
+	strict bool
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// SetStrict makes the encoder reject output that would not be canonical:
+// Marshaler results, such as a RawMessage, with unsorted or duplicate
+// dictionary keys, and structs with more than one field for the same key.
+func (e *Encoder) SetStrict(strict bool) {
+	e.strict = strict
+}
+
+// Encode writes the bencoding of v to the stream. See Marshal for how Go
+// values are encoded. If encoding fails part of v may already have been
+// written.
+func (e *Encoder) Encode(v any) error {
+	if err := e.encodeValue(reflect.ValueOf(v)); err != nil {
+		e.w.Flush()
+		return err
+	}
+	return e.w.Flush()
+}
+
+// Marshal returns the bencoding of v.
+//
+// Strings, []byte and byte arrays encode as byte strings; integer types and
+// bool (as 0 or 1) as integers; other slices and arrays as lists; maps with
+// string keys and structs as dictionaries with keys in sorted order. Struct
+// fields honour `bencode:"key,omitempty"` tags, and nil pointer or
+// interface fields are omitted; anywhere else, in a list or as a map value,
+// a nil pointer or interface is an error. Types implementing Marshaler,
+// such as RawMessage, are written verbatim after checking they hold one
+// valid value.
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (e *Encoder) encodeValue(v reflect.Value) error {
+	if !v.IsValid() {
+		return &UnsupportedValueError{"nil"}
+	}
+	if v.Type().Implements(marshalerType) {
+		if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil() {
+			return &UnsupportedValueError{"nil " + v.Type().String()}
+		}
+		return e.encodeMarshaler(v.Interface().(Marshaler))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.w.WriteByte('i')
+		e.w.WriteString(strconv.FormatInt(v.Int(), 10))
+		e.w.WriteByte('e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.w.WriteByte('i')
+		e.w.WriteString(strconv.FormatUint(v.Uint(), 10))
+		e.w.WriteByte('e')
+	case reflect.Bool:
+		if v.Bool() {
+			e.w.WriteString("i1e")
+		} else {
+			e.w.WriteString("i0e")
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.writeBytes(v)
+			return nil
+		}
+		e.w.WriteByte('l')
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encodeValue(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		e.w.WriteByte('e')
+	case reflect.Map:
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return &UnsupportedValueError{"nil " + v.Type().String()}
+		}
+		return e.encodeValue(v.Elem())
+	default:
+		return &UnsupportedTypeError{v.Type()}
+	}
+	return nil
+}
+
+func (e *Encoder) encodeMarshaler(m Marshaler) error {
+	b, err := m.MarshalBencode()
+	if err != nil {
+		return err
+	}
+	if e.strict {
+		err = CheckCanonical(b)
+	} else if _, n, decodeErr := DecodeBytes(b); decodeErr != nil {
+		err = decodeErr
+	} else if n != len(b) {
+		err = fmt.Errorf("%w: trailing data after value", ErrUnexpectedByte)
+	}
+	if err != nil {
+		return fmt.Errorf("bencode: invalid output from %T: %w", m, err)
+	}
+	e.w.Write(b)
+	return nil
+}
+
+func (e *Encoder) writeString(s string) {
+	e.w.WriteString(strconv.Itoa(len(s)))
+	e.w.WriteByte(':')
+	e.w.WriteString(s)
+}
+
+func (e *Encoder) writeBytes(v reflect.Value) {
+	e.w.WriteString(strconv.Itoa(v.Len()))
+	e.w.WriteByte(':')
+	if v.Kind() == reflect.Slice {
+		e.w.Write(v.Bytes())
+		return
+	}
+	for i := 0; i < v.Len(); i++ {
+		e.w.WriteByte(byte(v.Index(i).Uint()))
+	}
+}
+
+func (e *Encoder) encodeMap(v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return &UnsupportedTypeError{v.Type()}
+	}
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+
+	e.w.WriteByte('d')
+	for _, k := range keys {
+		elem := v.MapIndex(reflect.ValueOf(k).Convert(v.Type().Key()))
+		e.writeString(k)
+		if err := e.encodeValue(elem); err != nil {
+			return fmt.Errorf("key %q: %w", k, err)
+		}
+	}
+	e.w.WriteByte('e')
+	return nil
+}
+
+func (e *Encoder) encodeStruct(v reflect.Value) error {
+	fields := cachedFields(v.Type())
+	if e.strict && len(fields.conflicts) > 0 {
+		return fmt.Errorf("bencode: %s: %w %q", v.Type(), ErrDuplicateKey, fields.conflicts[0])
+	}
+	e.w.WriteByte('d')
+	for _, f := range fields.list {
+		fv := v.FieldByIndex(f.index)
+		if isNilValue(fv) || (f.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+		e.writeString(f.name)
+		if err := e.encodeValue(fv); err != nil {
+			return fmt.Errorf("field %q: %w", f.name, err)
+		}
+	}
+	e.w.WriteByte('e')
+	return nil
+}
+
+// isNilValue reports whether v is a nil pointer or interface, which has no
+// bencoded form and is left out of structs.
+func isNilValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return !v.IsValid()
+}
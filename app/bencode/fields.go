@@ -0,0 +1,106 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// field describes a struct field that maps to a dictionary key.
+type field struct {
+	name      string
+	index     []int
+	typ       reflect.Type
+	omitEmpty bool
+}
+
+// structFields lists the dictionary fields of a struct type sorted by key,
+// along with keys claimed by several fields at the same depth, which are
+// left out.
+type structFields struct {
+	list      []field
+	conflicts []string
+}
+
+var fieldCache sync.Map // map[reflect.Type]structFields
+
+func cachedFields(t reflect.Type) structFields {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(structFields)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.(structFields)
+}
+
+func typeFields(t reflect.Type) structFields {
+	var fields []field
+	collectFields(t, nil, &fields)
+
+	// A field declared at a shallower depth hides deeper fields with the
+	// same key; fields with the same key at the same depth cancel out.
+	sort.SliceStable(fields, func(i, j int) bool {
+		if fields[i].name != fields[j].name {
+			return fields[i].name < fields[j].name
+		}
+		return len(fields[i].index) < len(fields[j].index)
+	})
+	var sf structFields
+	for i := 0; i < len(fields); {
+		j := i + 1
+		for j < len(fields) && fields[j].name == fields[i].name {
+			j++
+		}
+		if j-i == 1 || len(fields[i].index) < len(fields[i+1].index) {
+			sf.list = append(sf.list, fields[i])
+		} else {
+			sf.conflicts = append(sf.conflicts, fields[i].name)
+		}
+		i = j
+	}
+	return sf
+}
+
+func collectFields(t reflect.Type, index []int, fields *[]field) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, hasTag := sf.Tag.Lookup("bencode")
+		if tag == "-" {
+			continue
+		}
+		idx := append(append([]int(nil), index...), i)
+		if sf.Anonymous && !hasTag && sf.Type.Kind() == reflect.Struct {
+			collectFields(sf.Type, idx, fields)
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+		*fields = append(*fields, field{
+			name:      name,
+			index:     idx,
+			typ:       sf.Type,
+			omitEmpty: opts == "omitempty",
+		})
+	}
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
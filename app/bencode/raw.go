@@ -0,0 +1,43 @@
+package bencode
+
+import "errors"
+
+// Unmarshaler is implemented by types that decode their own bencoded
+// representation. UnmarshalBencode receives the exact input bytes of one
+// value and must copy them if it wishes to retain them.
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
+
+// Marshaler is implemented by types that produce their own bencoded
+// representation.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// RawMessage is a raw encoded bencode value. It can be used to delay
+// decoding part of a message or to keep the exact bytes of a value, such as
+// a torrent's info dictionary, for hashing.
+type RawMessage []byte
+
+// MarshalBencode returns m as the bencoding of m.
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if len(m) == 0 {
+		return nil, errors.New("bencode: empty RawMessage")
+	}
+	return m, nil
+}
+
+// UnmarshalBencode sets *m to a copy of data.
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	if m == nil {
+		return errors.New("bencode: UnmarshalBencode on nil pointer")
+	}
+	*m = append((*m)[0:0], data...)
+	return nil
+}
+
+var (
+	_ Marshaler   = RawMessage(nil)
+	_ Unmarshaler = (*RawMessage)(nil)
+)
@@ -0,0 +1,284 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// An InvalidUnmarshalError describes an invalid argument passed to
+// Unmarshal or Decoder.Decode.
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "bencode: Unmarshal(nil)"
+	}
+	if e.Type.Kind() != reflect.Pointer {
+		return "bencode: Unmarshal(non-pointer " + e.Type.String() + ")"
+	}
+	return "bencode: Unmarshal(nil " + e.Type.String() + ")"
+}
+
+// An UnmarshalTypeError describes a bencoded value that cannot be stored in
+// a Go value of a specific type.
+type UnmarshalTypeError struct {
+	Value  string // "string", "integer", "list" or "dictionary"
+	Type   reflect.Type
+	Offset int64
+	Field  string
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("bencode: cannot unmarshal %s into field %q of type %s at offset %d", e.Value, e.Field, e.Type, e.Offset)
+	}
+	return fmt.Sprintf("bencode: cannot unmarshal %s into Go value of type %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+var unmarshalerType = reflect.TypeFor[Unmarshaler]()
+
+// Unmarshal parses the bencoded data and stores the result in the value
+// pointed to by v.
+//
+// Byte strings decode into strings, []byte and byte arrays of the same
+// length; integers into any integer type that can hold them; lists into
+// slices and arrays; dictionaries into maps with string keys and into
+// structs, matching keys against field names or `bencode:"key"` tags.
+// Unknown dictionary keys are skipped. Into an interface value, Unmarshal
+// stores the same types as DecodeBytes. Types implementing Unmarshaler,
+// such as RawMessage, receive the exact bytes of their value.
+//
+// Data following the first value is an error.
+func Unmarshal(data []byte, v any) error {
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) {
+			return d.syntaxError(ErrUnexpectedEOF)
+		}
+		return err
+	}
+	if int(d.off) != len(data) {
+		return d.syntaxError(fmt.Errorf("%w: trailing data after top-level value", ErrUnexpectedByte))
+	}
+	return nil
+}
+
+func (d *Decoder) typeError(kind string, t reflect.Type) error {
+	return &UnmarshalTypeError{Value: kind, Type: t, Offset: d.off}
+}
+
+func (d *Decoder) decodeInto(v reflect.Value) error {
+	// Allocate through pointers, stopping early for Unmarshalers.
+	for {
+		if v.CanAddr() && v.Addr().Type().Implements(unmarshalerType) && v.Kind() != reflect.Pointer {
+			return d.decodeUnmarshaler(v.Addr().Interface().(Unmarshaler))
+		}
+		if v.Kind() != reflect.Pointer {
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		x, err := d.value()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(x))
+		return nil
+	}
+
+	c, err := d.peekByte()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c >= '0' && c <= '9':
+		return d.decodeString(v)
+	case c == 'i':
+		return d.decodeInt(v)
+	case c == 'l':
+		return d.decodeList(v)
+	case c == 'd':
+		return d.decodeDict(v)
+	}
+	return d.syntaxError(fmt.Errorf("%w %q", ErrUnexpectedByte, c))
+}
+
+func (d *Decoder) decodeUnmarshaler(u Unmarshaler) error {
+	d.recording++
+	start := len(d.raw)
+	_, err := d.value()
+	raw := d.raw[start:]
+	d.recording--
+	if d.recording == 0 {
+		defer func() { d.raw = d.raw[:0] }()
+	}
+	if err != nil {
+		return err
+	}
+	return u.UnmarshalBencode(raw)
+}
+
+func (d *Decoder) decodeString(v reflect.Value) error {
+	off := d.off
+	s, err := d.readString()
+	if err != nil {
+		return err
+	}
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(s))
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(s)
+		return nil
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(s) != v.Len() {
+			return &UnmarshalTypeError{Value: fmt.Sprintf("string of length %d", len(s)), Type: v.Type(), Offset: off}
+		}
+		reflect.Copy(v, reflect.ValueOf(s))
+		return nil
+	}
+	return &UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: off}
+}
+
+func (d *Decoder) decodeInt(v reflect.Value) error {
+	off := d.off
+	n, err := d.readInt()
+	if err != nil {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(n) {
+			break
+		}
+		v.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			break
+		}
+		v.SetUint(uint64(n))
+		return nil
+	case reflect.Bool:
+		if n != 0 && n != 1 {
+			break
+		}
+		v.SetBool(n == 1)
+		return nil
+	}
+	return &UnmarshalTypeError{Value: fmt.Sprintf("integer %d", n), Type: v.Type(), Offset: off}
+}
+
+func (d *Decoder) decodeList(v reflect.Value) error {
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return d.typeError("list", v.Type())
+	}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	i := 0
+	for ; ; i++ {
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.readByte()
+			break
+		}
+		if v.Kind() == reflect.Slice {
+			if i >= v.Cap() {
+				v.Grow(1)
+			}
+			if i >= v.Len() {
+				v.SetLen(i + 1)
+			}
+		} else if i >= v.Len() {
+			return d.typeError(fmt.Sprintf("list longer than %d", v.Len()), v.Type())
+		}
+		if err := d.decodeInto(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	if v.Kind() == reflect.Slice {
+		if i == 0 && v.IsNil() {
+			v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		} else {
+			v.SetLen(i)
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) decodeDict(v reflect.Value) error {
+	var fields []field
+	switch {
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case v.Kind() == reflect.Struct:
+		fields = cachedFields(v.Type()).list
+	default:
+		return d.typeError("dictionary", v.Type())
+	}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	for {
+		key, done, err := d.dictKey()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		if v.Kind() == reflect.Map {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decodeInto(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+			continue
+		}
+
+		f := findField(fields, key)
+		if f == nil {
+			if _, err := d.value(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decodeInto(v.FieldByIndex(f.index)); err != nil {
+			if te, ok := err.(*UnmarshalTypeError); ok && te.Field == "" {
+				te.Field = key
+			}
+			return err
+		}
+	}
+}
+
+func findField(fields []field, name string) *field {
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+	}
+	return nil
+}
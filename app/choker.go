@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// unchokeInterval is how often upload slots are handed out again.
+	unchokeInterval = 10 * time.Second
+	// optimisticInterval is how long an optimistic unchoke lasts before it
+	// moves on to another peer.
+	optimisticInterval = 30 * time.Second
+	// uploadSlots is the number of peers unchoked for their rates, not
+	// counting the optimistic unchoke.
+	uploadSlots = 4
+	// snubTimeout is how long a peer may leave us waiting for data before
+	// we count it as snubbing us.
+	snubTimeout = time.Minute
+	// newPeerWeight makes recently connected peers more likely to get the
+	// optimistic unchoke, since they have had no chance to earn a slot.
+	newPeerWeight = 3
+)
+
+// chokerPeer is the choker's view of a connected peer. The connection's
+// goroutine updates the counters and applies the decisions sent on choke.
+type chokerPeer struct {
+	peerInterested atomic.Bool
+	amInterested   atomic.Bool
+	downloaded     atomic.Int64 // payload received from the peer
+	uploaded       atomic.Int64 // payload sent to the peer
+	waitingSince   atomic.Int64 // unix nanos of the last block, or of becoming interested
+	connected      time.Time
+
+	// choke carries the latest decision: true to choke, false to unchoke
+	choke chan bool
+
+	// owned by the choker
+	unchoked                     bool
+	lastDownloaded, lastUploaded int64
+	downloadRate, uploadRate     float64
+}
+
+// wantData records whether we are interested in the peer's pieces.
+func (p *chokerPeer) wantData(interested bool) {
+	if interested && !p.amInterested.Swap(true) {
+		p.waitingSince.Store(time.Now().UnixNano())
+	} else if !interested {
+		p.amInterested.Store(false)
+	}
+}
+
+// received records a block the peer sent us.
+func (p *chokerPeer) received(n int) {
+	p.downloaded.Add(int64(n))
+	p.waitingSince.Store(time.Now().UnixNano())
+}
+
+// snubbed reports whether the peer has sent us nothing for snubTimeout
+// while we wanted its pieces.
+func (p *chokerPeer) snubbed(now time.Time) bool {
+	return p.amInterested.Load() && now.Sub(time.Unix(0, p.waitingSince.Load())) > snubTimeout
+}
+
+func (p *chokerPeer) decide(choking bool) {
+	select {
+	case <-p.choke:
+	default:
+	}
+	p.choke <- choking
+}
+
+// choker decides which peers we upload to, tit-for-tat: every
+// unchokeInterval the uploadSlots interested peers that give us the most
+// are unchoked, by the rate they upload to us while we download and by the
+// rate we upload to them once we seed. One more peer is unchoked
+// optimistically, rotating every optimisticInterval, so that new peers get
+// a chance to prove themselves. A peer that snubs us only ever gets the
+// optimistic unchoke.
+type choker struct {
+	seeding func() bool
+
+	mu         sync.Mutex
+	peers      map[*chokerPeer]bool
+	optimistic *chokerPeer
+	lastRates  time.Time
+}
+
+func newChoker(seeding func() bool) *choker {
+	return &choker{
+		seeding:   seeding,
+		peers:     map[*chokerPeer]bool{},
+		lastRates: time.Now(),
+	}
+}
+
+// add registers a new connection, which starts out choked.
+func (c *choker) add() *chokerPeer {
+	p := &chokerPeer{connected: time.Now(), choke: make(chan bool, 1)}
+	p.waitingSince.Store(p.connected.UnixNano())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peers[p] = true
+	return p
+}
+
+// remove forgets a closed connection and hands its slot to someone else.
+func (c *choker) remove(p *chokerPeer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.peers, p)
+	if c.optimistic == p {
+		c.optimistic = nil
+	}
+	if p.unchoked {
+		c.rechoke()
+	}
+}
+
+// interestChanged fills a free slot as soon as a peer becomes interested,
+// rather than at the next round.
+func (c *choker) interestChanged() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rechoke()
+}
+
+// run reassigns the slots every unchokeInterval until ctx is done.
+func (c *choker) run(ctx context.Context) {
+	ticker := time.NewTicker(unchokeInterval)
+	defer ticker.Stop()
+	rotateEvery := int(optimisticInterval / unchokeInterval)
+	for round := 1; ; round++ {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		c.mu.Lock()
+		c.updateRates()
+		if round%rotateEvery == 0 {
+			c.optimistic = nil
+		}
+		c.rechoke()
+		c.mu.Unlock()
+	}
+}
+
+// updateRates measures each peer's rates since the previous round.
+func (c *choker) updateRates() {
+	now := time.Now()
+	elapsed := now.Sub(c.lastRates).Seconds()
+	c.lastRates = now
+	if elapsed <= 0 {
+		return
+	}
+	for p := range c.peers {
+		downloaded, uploaded := p.downloaded.Load(), p.uploaded.Load()
+		p.downloadRate = float64(downloaded-p.lastDownloaded) / elapsed
+		p.uploadRate = float64(uploaded-p.lastUploaded) / elapsed
+		p.lastDownloaded, p.lastUploaded = downloaded, uploaded
+	}
+}
+
+// rechoke hands out the regular slots by rate and the optimistic slot, and
+// tells every peer whose state changes. c.mu must be held.
+func (c *choker) rechoke() {
+	now := time.Now()
+	seeding := c.seeding()
+	rate := func(p *chokerPeer) float64 {
+		if seeding {
+			return p.uploadRate
+		}
+		return p.downloadRate
+	}
+
+	var candidates []*chokerPeer
+	for p := range c.peers {
+		if p.peerInterested.Load() && (seeding || !p.snubbed(now)) {
+			candidates = append(candidates, p)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if rate(a) != rate(b) {
+			return rate(a) > rate(b)
+		}
+		// on a tie, peers keep the slots they have
+		return a.unchoked && !b.unchoked
+	})
+	unchoke := map[*chokerPeer]bool{}
+	for _, p := range candidates[:min(uploadSlots, len(candidates))] {
+		unchoke[p] = true
+	}
+
+	if o := c.optimistic; o != nil && (unchoke[o] || !o.peerInterested.Load()) {
+		c.optimistic = nil
+	}
+	if c.optimistic == nil {
+		c.optimistic = c.pickOptimistic(unchoke, now)
+	}
+
+	for p := range c.peers {
+		want := unchoke[p] || p == c.optimistic
+		if want != p.unchoked {
+			p.unchoked = want
+			p.decide(!want)
+		}
+	}
+}
+
+// pickOptimistic chooses an interested peer without a regular slot at
+// random, snubbing peers included, favouring new connections.
+func (c *choker) pickOptimistic(unchoke map[*chokerPeer]bool, now time.Time) *chokerPeer {
+	var picked *chokerPeer
+	total := 0
+	for p := range c.peers {
+		if unchoke[p] || !p.peerInterested.Load() {
+			continue
+		}
+		weight := 1
+		if now.Sub(p.connected) < optimisticInterval {
+			weight = newPeerWeight
+		}
+		// weighted reservoir sampling
+		total += weight
+		if rand.IntN(total) < weight {
+			picked = p
+		}
+	}
+	return picked
+}
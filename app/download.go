@@ -0,0 +1,616 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
+)
+
+// torrentDownload coordinates the peer workers downloading one torrent.
+// Peers can be added at any time, e.g. as trackers report them.
+type torrentDownload struct {
+	ctx      context.Context
+	fail     context.CancelCauseFunc
+	infoHash [20]byte
+	info     *Info
+	storage  Storage
+
+	remaining  atomic.Int64 // pieces not yet verified
+	downloaded atomic.Int64 // payload bytes received
+	left       atomic.Int64 // bytes of unverified pieces
+	done       chan struct{}
+
+	picker *PiecePicker
+	seed   *seedTorrent // serves verified pieces to inbound peers
+
+	mu      sync.Mutex
+	changed chan struct{}          // closed when a piece is given back to the picker
+	pieces  map[int]*pieceDownload // pieces being downloaded
+	endgame bool
+	active  map[netip.AddrPort]bool
+	wg      sync.WaitGroup
+}
+
+// newTorrentDownload prepares a download into storage; cancelling ctx
+// makes every worker disconnect.
+func newTorrentDownload(ctx context.Context, infoHash [20]byte, info *Info, storage Storage) *torrentDownload {
+	numPieces := info.NumPieces()
+	ctx, fail := context.WithCancelCause(ctx)
+	d := &torrentDownload{
+		ctx:      ctx,
+		fail:     fail,
+		infoHash: infoHash,
+		info:     info,
+		storage:  storage,
+		done:     make(chan struct{}),
+		picker:   NewPiecePicker(numPieces),
+		changed:  make(chan struct{}),
+		pieces:   map[int]*pieceDownload{},
+		active:   map[netip.AddrPort]bool{},
+	}
+	d.seed = newSeedTorrent(infoHash, info, storage, nil)
+	d.remaining.Store(int64(numPieces))
+	d.left.Store(info.TotalLength())
+	if numPieces == 0 {
+		close(d.done)
+	}
+	return d
+}
+
+// openDownload prepares a download to outputPath in the named kind of
+// storage. Pieces that an earlier, interrupted run left on disk are kept.
+func openDownload(ctx context.Context, outputPath, storageKind string, infoHash [20]byte, info *Info) (*torrentDownload, error) {
+	have := newBitfield(info.NumPieces())
+	if storageKind != "memory" {
+		var err error
+		if have, err = loadResume(outputPath, infoHash, info); err != nil {
+			return nil, err
+		}
+	}
+	storage, err := openStorage(storageKind, outputPath, info)
+	if err != nil {
+		return nil, err
+	}
+	d := newTorrentDownload(ctx, infoHash, info, storage)
+	d.markVerified(have)
+	return d, nil
+}
+
+// close closes the download's storage and keeps its progress: a download
+// on disk gets a resume sidecar, and a complete download held in memory is
+// written to its files.
+func (d *torrentDownload) close(outputPath, storageKind string) error {
+	if storageKind == "memory" {
+		if d.remaining.Load() > 0 {
+			return nil
+		}
+		return saveDownload(outputPath, d.info, d.storage)
+	}
+	if err := d.storage.Close(); err != nil {
+		return err
+	}
+	return saveResume(outputPath, d.infoHash, d.info, d.seed.bitfield())
+}
+
+// Stats reports transfer totals for tracker announces.
+func (d *torrentDownload) Stats() (uploaded, downloaded, left int64) {
+	return d.seed.uploaded.Load(), d.downloaded.Load(), d.left.Load()
+}
+
+// markVerified records pieces that were already on disk, e.g. from an
+// earlier run, so that only the missing pieces are requested. It must be
+// called before run.
+func (d *torrentDownload) markVerified(have Bitfield) {
+	for i := 0; i < d.info.NumPieces(); i++ {
+		if !have.Has(i) {
+			continue
+		}
+		d.picker.Done(i)
+		d.seed.markHave(i)
+		d.left.Add(-int64(d.info.PieceSize(i)))
+		if d.remaining.Add(-1) == 0 {
+			close(d.done)
+		}
+	}
+}
+
+// Done is closed once every piece has been downloaded and verified.
+func (d *torrentDownload) Done() <-chan struct{} {
+	return d.done
+}
+
+// addPeer starts a worker for peer unless one is already running.
+func (d *torrentDownload) addPeer(peer Peer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.active[peer.Addr] {
+		return
+	}
+	select {
+	case <-d.done:
+		return
+	default:
+	}
+	d.active[peer.Addr] = true
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		err := d.handlePeer(peer)
+		if err != nil {
+			fmt.Println("Worker failed:", err)
+		}
+		d.mu.Lock()
+		delete(d.active, peer.Addr)
+		d.mu.Unlock()
+	}()
+}
+
+// run adds peers as they arrive until the download completes or its
+// context is cancelled, then waits for the workers to finish.
+func (d *torrentDownload) run(peers <-chan Peer) error {
+	defer d.wg.Wait()
+	go d.seed.choker.run(d.ctx)
+	for {
+		select {
+		case peer := <-peers:
+			d.addPeer(peer)
+		case <-d.done:
+			return nil
+		case <-d.ctx.Done():
+			return context.Cause(d.ctx)
+		}
+	}
+}
+
+// assign gives a worker a piece its peer has. Each piece normally goes to
+// a single worker; in endgame, workers join pieces that others are still
+// downloading so that one slow peer cannot hold up the finish.
+func (d *torrentDownload) assign(w *peerDownload) (*pieceDownload, bool) {
+	has := w.pc.Has
+	if index, ok := d.picker.Pick(has); ok {
+		piece := newPieceDownload(PieceTask{Index: index, Hash: d.info.Pieces[index], Size: d.info.PieceSize(index)})
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.pieces[index] = piece
+		piece.holders[w] = true
+		return piece, true
+	}
+	d.updateEndgame()
+	index, ok := d.picker.PickEndgame(has, w.holds)
+	if !ok {
+		return nil, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	piece := d.pieces[index]
+	if piece == nil || piece.finished {
+		// finished or failed between picking and now
+		d.picker.Abort(index)
+		return nil, false
+	}
+	piece.holders[w] = true
+	return piece, true
+}
+
+// drop releases a worker's hold on a piece.
+func (d *torrentDownload) drop(w *peerDownload, piece *pieceDownload) {
+	d.mu.Lock()
+	delete(piece.holders, w)
+	d.mu.Unlock()
+	d.picker.Abort(piece.task.Index)
+	d.notify()
+}
+
+// notify wakes workers waiting for a piece to become available.
+func (d *torrentDownload) notify() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// pendingChanged returns a channel that is closed the next time a piece
+// may have become available.
+func (d *torrentDownload) pendingChanged() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.changed
+}
+
+// updateEndgame reports entering and leaving endgame.
+func (d *torrentDownload) updateEndgame() {
+	endgame := d.picker.Endgame()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if endgame == d.endgame {
+		return
+	}
+	d.endgame = endgame
+	if endgame {
+		fmt.Printf("Entering endgame mode (remaining pieces: %d)\n", d.picker.Remaining())
+	} else {
+		fmt.Println("Leaving endgame mode")
+	}
+}
+
+// nextRequest returns the next block of piece that the worker has not
+// requested and nobody has delivered yet.
+func (d *torrentDownload) nextRequest(held *heldPiece) (begin, length int, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	piece := held.piece
+	for held.next < piece.task.Size {
+		begin = held.next
+		length = min(BlockSize, piece.task.Size-begin)
+		held.next += length
+		if !piece.blocks[begin/BlockSize] {
+			return begin, length, true
+		}
+	}
+	return 0, 0, false
+}
+
+// receive stores a block and reports whether it completed the piece. The
+// first block to arrive wins; other workers that requested it are told to
+// cancel their requests.
+func (d *torrentDownload) receive(w *peerDownload, piece *pieceDownload, begin int, block []byte) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if piece.finished {
+		return false, nil
+	}
+	complete, fresh, err := piece.receive(begin, block)
+	if err != nil || !fresh {
+		return false, err
+	}
+	for other := range piece.holders {
+		if other == w {
+			continue
+		}
+		select {
+		case other.cancels <- blockRequest{index: piece.task.Index, begin: begin, length: len(block)}:
+		default:
+			// a cancel is only an optimisation
+		}
+	}
+	if complete {
+		piece.finished = true
+		delete(d.pieces, piece.task.Index)
+	}
+	return complete, nil
+}
+
+// complete writes a verified piece to storage. A storage error ends the
+// whole download, since every other piece would fail the same way.
+func (d *torrentDownload) complete(index int, piece []byte) error {
+	_, err := d.storage.WriteAt(piece, int64(index)*d.info.PieceLength)
+	if err == nil {
+		err = d.storage.MarkComplete(index)
+	}
+	if err != nil {
+		err = fmt.Errorf("saving piece %d: %w", index, err)
+		d.fail(err)
+		return err
+	}
+	d.picker.Done(index)
+	d.seed.markHave(index)
+	d.left.Add(-int64(len(piece)))
+	if d.remaining.Add(-1) == 0 {
+		close(d.done)
+	}
+	d.updateEndgame()
+	return nil
+}
+
+// pieceDownload collects the blocks of a piece. In endgame several workers
+// share one, so it is guarded by the download's mutex.
+type pieceDownload struct {
+	task     PieceTask
+	buf      []byte
+	blocks   []bool
+	received int
+	finished bool // complete, and handed to one worker to verify
+	holders  map[*peerDownload]bool
+}
+
+func newPieceDownload(task PieceTask) *pieceDownload {
+	return &pieceDownload{
+		task:    task,
+		buf:     make([]byte, task.Size),
+		blocks:  make([]bool, (task.Size+BlockSize-1)/BlockSize),
+		holders: map[*peerDownload]bool{},
+	}
+}
+
+// receive stores a block and reports whether the piece is complete and
+// whether the block was new.
+func (p *pieceDownload) receive(begin int, block []byte) (complete, fresh bool, err error) {
+	if begin%BlockSize != 0 || begin+len(block) > p.task.Size ||
+		len(block) != min(BlockSize, p.task.Size-begin) {
+		return false, false, fmt.Errorf("unexpected block at offset %d of piece %d", begin, p.task.Index)
+	}
+	if p.blocks[begin/BlockSize] {
+		return false, false, nil
+	}
+	p.blocks[begin/BlockSize] = true
+	copy(p.buf[begin:], block)
+	p.received += len(block)
+	return p.received == p.task.Size, true, nil
+}
+
+// heldPiece is a worker's hold on a piece along with how far it has
+// requested it.
+type heldPiece struct {
+	piece *pieceDownload
+	next  int
+}
+
+// peerDownload is the state of one worker: the pieces it holds and the
+// requests it has in flight.
+type peerDownload struct {
+	d        *torrentDownload
+	pc       *PeerConn
+	pipeline *requestPipeline
+	upload   *uploadSession
+	pieces   []*heldPiece      // in the order they were assigned
+	cancels  chan blockRequest // blocks delivered by other peers
+}
+
+func (w *peerDownload) holds(index int) bool {
+	for _, h := range w.pieces {
+		if h.piece.task.Index == index {
+			return true
+		}
+	}
+	return false
+}
+
+// fill sends requests until the pipeline is full, taking new pieces once
+// the current ones have been fully requested.
+func (w *peerDownload) fill() error {
+	if w.pc.PeerChoking() {
+		return nil
+	}
+	for !w.pipeline.full() {
+		var held *heldPiece
+		var begin, length int
+		for _, h := range w.pieces {
+			var ok bool
+			if begin, length, ok = w.d.nextRequest(h); ok {
+				held = h
+				break
+			}
+		}
+		if held == nil {
+			piece, ok := w.d.assign(w)
+			if !ok {
+				return nil
+			}
+			held = &heldPiece{piece: piece}
+			w.pieces = append(w.pieces, held)
+			if begin, length, ok = w.d.nextRequest(held); !ok {
+				continue
+			}
+		}
+		if err := w.pc.Send(NewRequest(held.piece.task.Index, begin, length)); err != nil {
+			return err
+		}
+		w.pipeline.send(held.piece.task.Index, begin, length)
+	}
+	return nil
+}
+
+// release gives up every piece the worker holds.
+func (w *peerDownload) release() {
+	for _, h := range w.pieces {
+		w.d.drop(w, h.piece)
+	}
+	w.pieces = nil
+	w.pipeline.reset()
+}
+
+// forget drops a piece from the worker.
+func (w *peerDownload) forget(pos int) {
+	h := w.pieces[pos]
+	w.pieces = append(w.pieces[:pos], w.pieces[pos+1:]...)
+	w.pipeline.remove(h.piece.task.Index)
+	w.d.drop(w, h.piece)
+}
+
+// prune drops pieces that another worker has finished.
+func (w *peerDownload) prune() {
+	for i := len(w.pieces) - 1; i >= 0; i-- {
+		w.d.mu.Lock()
+		finished := w.pieces[i].piece.finished
+		w.d.mu.Unlock()
+		if finished {
+			w.forget(i)
+		}
+	}
+}
+
+// cancel withdraws a request for a block another peer delivered.
+func (w *peerDownload) cancel(req blockRequest) error {
+	if !w.pipeline.cancel(req.index, req.begin, req.length) {
+		return nil
+	}
+	return w.pc.Send(NewCancel(req.index, req.begin, req.length))
+}
+
+// receive handles a piece message.
+func (w *peerDownload) receive(msg *Message) error {
+	index, begin, block, err := msg.ParsePiece()
+	if err != nil {
+		return err
+	}
+	if !w.pipeline.receive(index, begin, len(block)) {
+		return nil // a late block for a request that was dropped
+	}
+	pos := -1
+	for i, h := range w.pieces {
+		if h.piece.task.Index == index {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return nil
+	}
+	w.d.downloaded.Add(int64(len(block)))
+	w.upload.peer.received(len(block))
+	piece := w.pieces[pos].piece
+	complete, err := w.d.receive(w, piece, begin, block)
+	if err != nil || !complete {
+		return err
+	}
+	if checkIntegrity(piece.buf, index, w.d.info) {
+		err = w.d.complete(index, piece.buf)
+	}
+	// a piece that fails the check is dropped by every holder and then
+	// picked again from scratch
+	w.forget(pos)
+	return err
+}
+
+func (d *torrentDownload) handlePeer(peer Peer) error {
+	conn, err := net.DialTimeout("tcp", peer.Addr.String(), 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(d.ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := doMagnetHandShake(conn, d.infoHash); err != nil {
+		return err
+	}
+	handshake, err := readHandShake(conn, d.infoHash)
+	if err != nil {
+		return err
+	}
+
+	pc := newPeerConn(conn, d.info.NumPieces())
+	// peers we download from may download from us too
+	upload, err := d.seed.join(pc)
+	if err != nil {
+		return err
+	}
+	defer upload.leave()
+	if handshake.Capabilities().Extensions {
+		// only to learn the peer's reqq; we offer no extensions
+		payload, err := bencode.Marshal(extensionHandshake{M: map[string]int{}, Reqq: maxQueueDepth})
+		if err != nil {
+			return err
+		}
+		if err := pc.Send(NewExtended(0, payload)); err != nil {
+			return err
+		}
+	}
+	events := make(chan peerEvent)
+	stopReading := make(chan struct{})
+	defer close(stopReading)
+	go pc.readLoop(events, stopReading)
+
+	w := &peerDownload{
+		d:        d,
+		pc:       pc,
+		pipeline: newRequestPipeline(),
+		upload:   upload,
+		cancels:  make(chan blockRequest, maxQueueDepth),
+	}
+	defer w.release()
+	// the bitfield is counted as it fills up, whether or not the peer
+	// sent one
+	defer func() { d.picker.RemoveBitfield(pc.bitfield) }()
+	interest := newPeerInterest(upload.joined)
+	for {
+		if err := pc.SetInterested(interest.interested()); err != nil {
+			return err
+		}
+		upload.peer.wantData(pc.AmInterested())
+		w.prune()
+		if err := w.fill(); err != nil {
+			return err
+		}
+
+		var ev peerEvent
+		select {
+		case ev = <-events:
+		case req := <-w.cancels:
+			if err := w.cancel(req); err != nil {
+				return err
+			}
+			continue
+		case index := <-upload.haves:
+			interest.weHave(index, pc.Has(index))
+			if err := pc.Send(NewHave(index)); err != nil {
+				return err
+			}
+			continue
+		case choking := <-upload.peer.choke:
+			if err := pc.SetChoking(choking); err != nil {
+				return err
+			}
+			continue
+		case <-d.pendingChanged():
+			continue
+		case <-d.done:
+			return nil
+		case <-d.ctx.Done():
+			return nil
+		}
+		if ev.err != nil {
+			return ev.err
+		}
+		hadPiece := ev.msg.ID == MsgHave && pc.Has(haveIndex(ev.msg))
+		if err := pc.handle(ev.msg); err != nil {
+			return err
+		}
+		if err := upload.handle(ev.msg); err != nil {
+			return err
+		}
+		switch ev.msg.ID {
+		case MsgBitfield:
+			d.picker.AddBitfield(pc.bitfield)
+			interest.peerBitfield(pc.bitfield)
+		case MsgHave:
+			if !hadPiece {
+				d.picker.AddHave(haveIndex(ev.msg))
+				interest.peerHas(haveIndex(ev.msg))
+			}
+		case MsgChoke:
+			// the peer drops our outstanding requests, so let other
+			// peers have the pieces
+			w.release()
+		case MsgPiece:
+			if err := w.receive(ev.msg); err != nil {
+				return err
+			}
+		case MsgExtended:
+			extID, payload, err := ev.msg.ParseExtended()
+			if err != nil || extID != 0 {
+				continue
+			}
+			var ext extensionHandshake
+			if bencode.Unmarshal(payload, &ext) == nil {
+				w.pipeline.setReqq(ext.Reqq)
+			}
+		}
+	}
+}
+
+// haveIndex returns the piece index of a have message, or -1 if it is
+// malformed.
+func haveIndex(msg *Message) int {
+	index, err := msg.ParseHave()
+	if err != nil {
+		return -1
+	}
+	return index
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// fileSpan is the part of a byte range of the torrent that falls within a
+// single file.
+type fileSpan struct {
+	FileIndex  int
+	FileOffset int64 // offset within the file
+	Offset     int64 // offset within the requested range
+	Length     int64
+}
+
+type layoutFile struct {
+	path   string
+	offset int64 // offset of the file's first byte within the torrent
+	length int64
+}
+
+// fileLayout maps the torrent's contiguous byte stream, which pieces are
+// cut from, onto the files it is stored in.
+type fileLayout struct {
+	files    []layoutFile
+	total    int64
+	readOnly bool // open existing files only, for seeding
+
+	mu      sync.Mutex
+	handles map[int]*os.File
+	closed  bool
+}
+
+// newFileLayout lays the torrent's files out on disk. A single-file torrent
+// is stored at outputPath itself; a multi-file torrent is stored in a
+// directory named after the torrent inside outputPath.
+func newFileLayout(outputPath string, info *Info) *fileLayout {
+	l := &fileLayout{handles: map[int]*os.File{}}
+	if !info.IsMultiFile() {
+		l.files = []layoutFile{{path: outputPath, length: info.Length}}
+		l.total = info.Length
+		return l
+	}
+	root := filepath.Join(outputPath, info.Name)
+	for _, f := range info.Files {
+		l.files = append(l.files, layoutFile{
+			path:   filepath.Join(append([]string{root}, f.Path...)...),
+			offset: l.total,
+			length: f.Length,
+		})
+		l.total += f.Length
+	}
+	return l
+}
+
+// spans returns the file regions covered by length bytes starting at
+// offset within the torrent, in order.
+func (l *fileLayout) spans(offset, length int64) []fileSpan {
+	// first file that ends after offset
+	i := sort.Search(len(l.files), func(i int) bool {
+		return l.files[i].offset+l.files[i].length > offset
+	})
+	var spans []fileSpan
+	pos := offset
+	for ; i < len(l.files) && pos < offset+length; i++ {
+		f := l.files[i]
+		if f.length == 0 {
+			continue
+		}
+		n := min(f.offset+f.length, offset+length) - pos
+		spans = append(spans, fileSpan{
+			FileIndex:  i,
+			FileOffset: pos - f.offset,
+			Offset:     pos - offset,
+			Length:     n,
+		})
+		pos += n
+	}
+	return spans
+}
+
+func (l *fileLayout) file(index int) (*os.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, os.ErrClosed
+	}
+	if f, ok := l.handles[index]; ok {
+		return f, nil
+	}
+	path := l.files[index].path
+	if l.readOnly {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		l.handles[index] = f
+		return f, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.handles[index] = f
+	return f, nil
+}
+
+// WriteAt writes p at offset off within the torrent, splitting it across
+// file boundaries as needed.
+func (l *fileLayout) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > l.total {
+		return 0, fmt.Errorf("write of %d bytes at %d outside torrent of %d bytes", len(p), off, l.total)
+	}
+	written := 0
+	for _, span := range l.spans(off, int64(len(p))) {
+		f, err := l.file(span.FileIndex)
+		if err != nil {
+			return written, err
+		}
+		n, err := f.WriteAt(p[span.Offset:span.Offset+span.Length], span.FileOffset)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ReadAt reads len(p) bytes at offset off within the torrent.
+func (l *fileLayout) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > l.total {
+		return 0, fmt.Errorf("read of %d bytes at %d outside torrent of %d bytes", len(p), off, l.total)
+	}
+	read := 0
+	for _, span := range l.spans(off, int64(len(p))) {
+		f, err := l.file(span.FileIndex)
+		if err != nil {
+			return read, err
+		}
+		n, err := f.ReadAt(p[span.Offset:span.Offset+span.Length], span.FileOffset)
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// create makes sure every file exists with its final size, including empty
+// files that no piece touches. Files that already have the right size are
+// left alone, keeping their mtimes for fast resume.
+func (l *fileLayout) create() error {
+	for i, lf := range l.files {
+		f, err := l.file(i)
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Size() == lf.length {
+			continue
+		}
+		if err := f.Truncate(lf.length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close syncs the files to disk, unless they were opened read-only, and
+// closes them; later reads and writes fail with os.ErrClosed.
+func (l *fileLayout) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	var firstErr error
+	for i, f := range l.handles {
+		if !l.readOnly {
+			if err := f.Sync(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(l.handles, i)
+	}
+	return firstErr
+}
+
+// saveDownload writes a complete download held elsewhere, such as in
+// memory, to its files under outputPath.
+func saveDownload(outputPath string, info *Info, data io.ReaderAt) error {
+	layout := newFileLayout(outputPath, info)
+	defer layout.Close()
+	if err := layout.create(); err != nil {
+		return err
+	}
+	buf := make([]byte, info.PieceSize(0))
+	for i := 0; i < info.NumPieces(); i++ {
+		piece := buf[:info.PieceSize(i)]
+		offset := int64(i) * info.PieceLength
+		if _, err := data.ReadAt(piece, offset); err != nil {
+			return err
+		}
+		if _, err := layout.WriteAt(piece, offset); err != nil {
+			return err
+		}
+	}
+	return layout.Close()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// multiFileInfo returns a multi-file torrent with files of the given
+// lengths, named 0, 1, ... The piece hashes are left zero.
+func multiFileInfo(pieceLength int64, lengths ...int64) *Info {
+	info := &Info{Name: "torrent", PieceLength: pieceLength}
+	var total int64
+	for i, length := range lengths {
+		info.Files = append(info.Files, File{Length: length, Path: []string{fmt.Sprint(i)}})
+		total += length
+	}
+	info.Pieces = make([][20]byte, (total+pieceLength-1)/pieceLength)
+	return info
+}
+
+func TestFileLayoutSpans(t *testing.T) {
+	tests := []struct {
+		name    string
+		lengths []int64
+		offset  int64
+		length  int64
+		want    []fileSpan
+	}{
+		{"within one file", []int64{10, 10}, 2, 4, []fileSpan{{0, 2, 0, 4}}},
+		{"two files", []int64{6, 10}, 4, 4, []fileSpan{{0, 4, 0, 2}, {1, 0, 2, 2}}},
+		{"three files", []int64{2, 1, 3}, 0, 6, []fileSpan{{0, 0, 0, 2}, {1, 0, 2, 1}, {2, 0, 3, 3}}},
+		{"starting at a file boundary", []int64{4, 4}, 4, 4, []fileSpan{{1, 0, 0, 4}}},
+		{"empty file in the middle", []int64{3, 0, 5}, 0, 4, []fileSpan{{0, 0, 0, 3}, {2, 0, 3, 1}}},
+		{"empty files at the start and end", []int64{0, 4, 0, 0}, 0, 4, []fileSpan{{1, 0, 0, 4}}},
+	}
+	for _, tt := range tests {
+		layout := newFileLayout(t.TempDir(), multiFileInfo(4, tt.lengths...))
+		if got := layout.spans(tt.offset, tt.length); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: spans(%d, %d) = %v, want %v", tt.name, tt.offset, tt.length, got, tt.want)
+		}
+	}
+}
+
+func TestPieceSize(t *testing.T) {
+	tests := []struct {
+		lengths []int64
+		want    []int // size of each piece
+	}{
+		{[]int64{8}, []int{4, 4}},
+		{[]int64{3, 0, 5, 2, 0}, []int{4, 4, 2}},
+		{[]int64{1}, []int{1}},
+	}
+	for _, tt := range tests {
+		info := multiFileInfo(4, tt.lengths...)
+		var got []int
+		for i := range info.NumPieces() {
+			got = append(got, info.PieceSize(i))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("files %v: piece sizes = %v, want %v", tt.lengths, got, tt.want)
+		}
+	}
+}
+
+// Pieces written across file boundaries land in the right files and read
+// back unchanged.
+func TestFileLayoutRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	lengths := []int64{0, 5, 3, 0, 9, 1, 0}
+	info := multiFileInfo(4, lengths...)
+	data := make([]byte, info.TotalLength())
+	for i := range data {
+		data[i] = byte(rand.N(256))
+	}
+
+	layout := newFileLayout(dir, info)
+	if err := layout.create(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range info.NumPieces() {
+		off := int64(i) * info.PieceLength
+		if _, err := layout.WriteAt(data[off:off+int64(info.PieceSize(i))], off); err != nil {
+			t.Fatalf("writing piece %d: %v", i, err)
+		}
+	}
+	got := make([]byte, len(data))
+	if _, err := layout.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("read back %x, want %x", got, data)
+	}
+	if _, err := layout.WriteAt([]byte{1}, int64(len(data))); err == nil {
+		t.Error("write past the end succeeded")
+	}
+	if err := layout.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := layout.ReadAt(got, 0); err == nil {
+		t.Error("read after Close succeeded")
+	}
+
+	var off int64
+	for i, length := range lengths {
+		content, err := os.ReadFile(filepath.Join(dir, info.Name, fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, data[off:off+length]) {
+			t.Errorf("file %d = %x, want %x", i, content, data[off:off+length])
+		}
+		off += length
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const protocolString = "BitTorrent protocol"
+
+// clientPrefix is the Azureus-style prefix of our peer ID: client code GB
+// (gobit-torrent), version 0.1.0.0.
+const clientPrefix = "-GB0100-"
+
+// localPeerID identifies this client to trackers and peers. It is random
+// per session so that peers and trackers cannot link sessions.
+var localPeerID = newPeerID()
+
+func newPeerID() [20]byte {
+	const chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	var id [20]byte
+	copy(id[:], clientPrefix)
+	rand.Read(id[len(clientPrefix):])
+	for i := len(clientPrefix); i < len(id); i++ {
+		id[i] = chars[int(id[i])%len(chars)]
+	}
+	return id
+}
+
+var (
+	ErrBadProtocol      = errors.New("peer does not speak the BitTorrent protocol")
+	ErrInfoHashMismatch = errors.New("peer handshake is for a different torrent")
+	ErrSelfConnection   = errors.New("connected to ourselves")
+)
+
+// Capabilities are the protocol extensions a peer announces in the
+// reserved bytes of its handshake.
+type Capabilities struct {
+	Extensions bool // BEP 10 extension protocol
+	Fast       bool // BEP 6 fast extension
+	DHT        bool // BEP 5 DHT
+}
+
+// Handshake is the first message exchanged on a peer connection.
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+func newHandshake(infoHash [20]byte, caps Capabilities) Handshake {
+	h := Handshake{InfoHash: infoHash, PeerID: localPeerID}
+	if caps.Extensions {
+		h.Reserved[5] |= 0x10
+	}
+	if caps.Fast {
+		h.Reserved[7] |= 0x04
+	}
+	if caps.DHT {
+		h.Reserved[7] |= 0x01
+	}
+	return h
+}
+
+func (h Handshake) Capabilities() Capabilities {
+	return Capabilities{
+		Extensions: h.Reserved[5]&0x10 != 0,
+		Fast:       h.Reserved[7]&0x04 != 0,
+		DHT:        h.Reserved[7]&0x01 != 0,
+	}
+}
+
+func (h Handshake) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 0, 68)
+	buf = append(buf, byte(len(protocolString)))
+	buf = append(buf, protocolString...)
+	buf = append(buf, h.Reserved[:]...)
+	buf = append(buf, h.InfoHash[:]...)
+	buf = append(buf, h.PeerID[:]...)
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadHandshake reads a handshake and checks its protocol string. It does
+// not check the info hash, which a listening peer needs to look up first.
+func ReadHandshake(r io.Reader) (Handshake, error) {
+	var h Handshake
+	buf := make([]byte, 68)
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return h, err
+	}
+	if int(buf[0]) != len(protocolString) {
+		return h, ErrBadProtocol
+	}
+	if _, err := io.ReadFull(r, buf[1:]); err != nil {
+		return h, err
+	}
+	if string(buf[1:20]) != protocolString {
+		return h, ErrBadProtocol
+	}
+	copy(h.Reserved[:], buf[20:28])
+	copy(h.InfoHash[:], buf[28:48])
+	copy(h.PeerID[:], buf[48:68])
+	return h, nil
+}
+
+// checkHandshake checks that a peer's handshake is for infoHash and does
+// not come from this client.
+func checkHandshake(h Handshake, infoHash [20]byte) error {
+	if h.InfoHash != infoHash {
+		return ErrInfoHashMismatch
+	}
+	if h.PeerID == localPeerID {
+		return ErrSelfConnection
+	}
+	return nil
+}
+
+// azureusClients maps the two-letter codes of Azureus-style peer IDs to
+// client names.
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"GB": "gobit-torrent",
+	"KT": "KTorrent",
+	"LT": "libtorrent (rakshasa)",
+	"lt": "libTorrent (Rasterbar)",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"WW": "WebTorrent",
+}
+
+// clientName describes the client that generated peerID, e.g.
+// "qBittorrent 4.2.5". It understands Azureus-style (-XX1234-) and
+// mainline-style (M1-2-3--) IDs.
+func clientName(peerID [20]byte) string {
+	id := string(peerID[:])
+	if id[0] == '-' && id[7] == '-' {
+		name, ok := azureusClients[id[1:3]]
+		if !ok {
+			name = id[1:3]
+		}
+		version := strings.Join(strings.Split(id[3:7], ""), ".")
+		for strings.HasSuffix(version, ".0") && len(version) > 3 {
+			version = strings.TrimSuffix(version, ".0")
+		}
+		return fmt.Sprintf("%s %s", name, version)
+	}
+	if id[0] == 'M' {
+		if end := strings.Index(id, "--"); end > 1 {
+			return "Mainline " + strings.ReplaceAll(id[1:end], "-", ".")
+		}
+	}
+	return "unknown"
+}
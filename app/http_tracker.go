@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
+)
+
+// maxTrackerResponse bounds how much of a tracker response is read.
+const maxTrackerResponse = 4 << 20
+
+type httpAnnounceResponse struct {
+	FailureReason  string `bencode:"failure reason"`
+	WarningMessage string `bencode:"warning message"`
+	Interval       int64  `bencode:"interval"`
+	MinInterval    int64  `bencode:"min interval"`
+	TrackerID      string `bencode:"tracker id"`
+	Complete       int    `bencode:"complete"`
+	Incomplete     int    `bencode:"incomplete"`
+
+	// Peers is either a compact string or a list of dictionaries.
+	Peers  bencode.RawMessage `bencode:"peers"`
+	Peers6 []byte             `bencode:"peers6"`
+}
+
+// httpTracker is a client for a single HTTP(S) tracker. It remembers the
+// tracker id the tracker hands out and sends it back on later announces.
+type httpTracker struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	trackerID string
+}
+
+func newHTTPTracker(trackerURL string) *httpTracker {
+	return &httpTracker{
+		url:    trackerURL,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Announce sends an announce request and returns the tracker's response.
+// A failure reported by the tracker is returned as a *TrackerError.
+func (t *httpTracker) Announce(ctx context.Context, req AnnounceRequest) (AnnounceResponse, error) {
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	query := u.Query()
+	query.Set("info_hash", string(req.InfoHash[:]))
+	query.Set("peer_id", string(req.PeerID[:]))
+	query.Set("port", strconv.Itoa(int(req.Port)))
+	query.Set("uploaded", strconv.FormatInt(req.Uploaded, 10))
+	query.Set("downloaded", strconv.FormatInt(req.Downloaded, 10))
+	query.Set("left", strconv.FormatInt(req.Left, 10))
+	query.Set("compact", "1")
+	if req.Event != EventNone {
+		query.Set("event", req.Event.String())
+	}
+	if req.NumWant > 0 {
+		query.Set("numwant", strconv.Itoa(req.NumWant))
+	}
+	if req.Key != 0 {
+		query.Set("key", fmt.Sprintf("%08x", req.Key))
+	}
+	if req.IP != nil {
+		query.Set("ip", req.IP.String())
+	}
+	t.mu.Lock()
+	if t.trackerID != "" {
+		query.Set("trackerid", t.trackerID)
+	}
+	t.mu.Unlock()
+	u.RawQuery = query.Encode()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	res, err := t.client.Do(httpReq)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxTrackerResponse))
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+
+	var parsed httpAnnounceResponse
+	decodeErr := bencode.NewDecoder(bytes.NewReader(body)).Decode(&parsed)
+	// trackers often send a failure reason along with an error status
+	if decodeErr == nil && parsed.FailureReason != "" {
+		return AnnounceResponse{}, &TrackerError{Reason: parsed.FailureReason}
+	}
+	if res.StatusCode != http.StatusOK {
+		return AnnounceResponse{}, fmt.Errorf("tracker response error: %s", res.Status)
+	}
+	if decodeErr != nil {
+		return AnnounceResponse{}, fmt.Errorf("invalid tracker response: %w", decodeErr)
+	}
+
+	var peers []Peer
+	if len(parsed.Peers) > 0 {
+		if parsed.Peers[0] == 'l' {
+			peers, err = parsePeerDicts(ctx, parsed.Peers)
+		} else {
+			var compact []byte
+			if err = bencode.Unmarshal(parsed.Peers, &compact); err == nil {
+				peers, err = parseCompactPeers(compact, 6)
+			}
+		}
+		if err != nil {
+			return AnnounceResponse{}, err
+		}
+	}
+	peers6, err := parseCompactPeers(parsed.Peers6, 18)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	peers = append(peers, peers6...)
+	if parsed.TrackerID != "" {
+		t.mu.Lock()
+		t.trackerID = parsed.TrackerID
+		t.mu.Unlock()
+	}
+	return AnnounceResponse{
+		Interval:    time.Duration(parsed.Interval) * time.Second,
+		MinInterval: time.Duration(parsed.MinInterval) * time.Second,
+		TrackerID:   parsed.TrackerID,
+		Warning:     parsed.WarningMessage,
+		Complete:    parsed.Complete,
+		Incomplete:  parsed.Incomplete,
+		Peers:       peers,
+	}, nil
+}
+
+type httpScrapeResponse struct {
+	FailureReason string `bencode:"failure reason"`
+	Files         map[string]struct {
+		Complete   int `bencode:"complete"`
+		Downloaded int `bencode:"downloaded"`
+		Incomplete int `bencode:"incomplete"`
+	} `bencode:"files"`
+}
+
+// scrapeURL derives the scrape URL from an announce URL by the convention
+// in BEP 48: the last path component must start with "announce", which is
+// replaced with "scrape".
+func scrapeURL(announceURL string) (string, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", ErrScrapeUnsupported
+	}
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(u.Path[i+1:], "announce")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// Scrape requests swarm statistics for infoHashes. Torrents the tracker
+// does not know are left out of the result.
+func (t *httpTracker) Scrape(ctx context.Context, infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	rawURL, err := scrapeURL(t.url)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	for _, h := range infoHashes {
+		query.Add("info_hash", string(h[:]))
+	}
+	u.RawQuery = query.Encode()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxTrackerResponse))
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed httpScrapeResponse
+	decodeErr := bencode.NewDecoder(bytes.NewReader(body)).Decode(&parsed)
+	if decodeErr == nil && parsed.FailureReason != "" {
+		return nil, &TrackerError{Reason: parsed.FailureReason}
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker response error: %s", res.Status)
+	}
+	if decodeErr != nil {
+		return nil, fmt.Errorf("invalid scrape response: %w", decodeErr)
+	}
+
+	results := make(map[[20]byte]ScrapeResult, len(parsed.Files))
+	for key, file := range parsed.Files {
+		if len(key) != 20 {
+			continue
+		}
+		results[[20]byte([]byte(key))] = ScrapeResult{
+			Complete:   file.Complete,
+			Downloaded: file.Downloaded,
+			Incomplete: file.Incomplete,
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Magnet is a parsed magnet link.
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string
+	Trackers []string
+}
+
+// ParseMagnet parses a magnet:? URI with a BitTorrent v1 info hash, given
+// in either hex or base32.
+func ParseMagnet(link string) (*Magnet, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet link: %q", link)
+	}
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Magnet{Name: params.Get("dn")}
+	found := false
+	for _, xt := range params["xt"] {
+		hash, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		var decoded []byte
+		switch len(hash) {
+		case 40:
+			decoded, err = hex.DecodeString(hash)
+		case 32:
+			decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = fmt.Errorf("invalid length %d", len(hash))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid info hash %q: %w", hash, err)
+		}
+		copy(m.InfoHash[:], decoded)
+		found = true
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("magnet link has no urn:btih info hash")
+	}
+
+	seen := map[string]bool{}
+	for _, tr := range params["tr"] {
+		if tr != "" && !seen[tr] {
+			seen[tr] = true
+			m.Trackers = append(m.Trackers, tr)
+		}
+	}
+	return m, nil
+}
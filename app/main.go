@@ -1,57 +1,31 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha1"
-	"encoding/binary"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net"
-	"net/url"
+	"net/http"
 	"os"
-	"sort"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
-	// bencode "github.com/jackpal/bencode-go"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
 )
 
 var _ = json.Marshal
 
 const BlockSize = 16 * 1024 // 16 KiB
 
-func bencodeEncode(value any) string {
-	switch v := value.(type) {
-	case string:
-		return fmt.Sprintf("%d:%s", len(v), v)
-	case int:
-		return fmt.Sprintf("i%de", v)
-	case []any:
-		result := "l"
-		for _, item := range v {
-			result += bencodeEncode(item)
-		}
-		result += "e"
-		return result
-	case map[string]any:
-		result := "d"
-		// keys must be sorted
-		keys := make([]string, 0, len(v))
-		for k := range v {
-			keys = append(keys, k)
-		}
-		sort.Strings(keys)
-		for _, k := range keys {
-			result += bencodeEncode(k)
-			result += bencodeEncode(v[k])
-		}
-		result += "e"
-		return result
-	default:
-		panic(fmt.Sprintf("Unsupported type: %T", v))
-	}
+// bencodeEncode returns the bencoding of value.
+func bencodeEncode(value any) ([]byte, error) {
+	return bencode.Marshal(value)
 }
 
 func main() {
@@ -60,7 +34,7 @@ func main() {
 	if command == "decode" {
 		bencodedValue := os.Args[2]
 
-		decoded, _, err := decodeBencode(bencodedValue)
+		decoded, _, err := decodeBencode([]byte(bencodedValue))
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -70,66 +44,39 @@ func main() {
 		fmt.Println(string(jsonOutput))
 	} else if command == "info" {
 		fileName := os.Args[2]
-		data, err := os.ReadFile(fileName)
-		if err != nil {
-			panic(err)
-		}
-		bencodedString := string(data)
-		decoded, _, err := decodeBencode(bencodedString)
+		meta, err := LoadMetainfo(fileName)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
-		dict, ok := decoded.(map[string]any)
-		if !ok {
-			fmt.Println("Invalid bencoded data")
-			return
-		}
-		info, ok := dict["info"].(map[string]any)
-		if !ok {
-			fmt.Println("Invalid bencoded data")
-			return
-		}
-		encodedInfo := bencodeEncode(info)
-		hash := sha1.Sum([]byte(encodedInfo))
 
-		fmt.Printf("Tracker URL: %s\n", dict["announce"])
-		fmt.Printf("Length: %d\n", info["length"])
-		fmt.Printf("Info Hash: %x\n", hash)
-		fmt.Printf("Piece Length: %d\n", info["piece length"])
+		fmt.Printf("Tracker URL: %s\n", meta.Announce)
+		fmt.Printf("Length: %d\n", meta.Info.TotalLength())
+		fmt.Printf("Info Hash: %x\n", meta.InfoHash)
+		fmt.Printf("Piece Length: %d\n", meta.Info.PieceLength)
 		fmt.Printf("Piece Hashes:\n")
 
-		piecesStr := info["pieces"].(string)
-		bytesPieces := []byte(piecesStr)
-		for i := 0; i < len(bytesPieces); i += 20 {
-			pieceHash := bytesPieces[i : i+20]
-			fmt.Println(hex.EncodeToString(pieceHash))
+		for _, pieceHash := range meta.Info.Pieces {
+			fmt.Println(hex.EncodeToString(pieceHash[:]))
+		}
+		if meta.Info.IsMultiFile() {
+			fmt.Printf("Files:\n")
+			for _, file := range meta.Info.Files {
+				fmt.Printf("%s (%d bytes)\n", filepath.Join(file.Path...), file.Length)
+			}
 		}
 
 	} else if command == "peers" {
 		fileName := os.Args[2]
-		data, err := os.ReadFile(fileName)
-		if err != nil {
-			panic(err)
-		}
-		bencodedString := string(data)
-		decoded, _, err := decodeBencode(bencodedString)
+		meta, err := LoadMetainfo(fileName)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
-		dict, ok := decoded.(map[string]any)
-		if !ok {
-			fmt.Println("Invalid bencoded data")
-			return
-		}
-		info, ok := dict["info"].(map[string]any)
-		if !ok {
-			fmt.Println("Invalid bencoded data")
-			return
-		}
 
-		peerList, err := getPeers(dict["announce"].(string), info)
+		peerList, err := meta.Trackers().announce(func(trackerURL string) ([]Peer, error) {
+			return getPeers(trackerURL, meta.InfoHash, meta.Info.TotalLength(), lookupPort)
+		})
 		if err != nil {
 			fmt.Println("Error getting peers:", err)
 			return
@@ -138,54 +85,89 @@ func main() {
 			fmt.Println(peer)
 		}
 
+	} else if command == "scrape" {
+		source := os.Args[2]
+
+		var infoHash [20]byte
+		var trackerURLs []string
+		if strings.HasPrefix(source, "magnet:") {
+			magnet, err := ParseMagnet(source)
+			if err != nil {
+				fmt.Println("Invalid magnet link:", err)
+				return
+			}
+			infoHash = magnet.InfoHash
+			trackerURLs = magnet.Trackers
+		} else {
+			meta, err := LoadMetainfo(source)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			infoHash = meta.InfoHash
+			trackerURLs = meta.Trackers().urls()
+		}
+		if len(trackerURLs) == 0 {
+			fmt.Println("No trackers to scrape")
+			return
+		}
+
+		results := make([]ScrapeResult, len(trackerURLs))
+		errs := make([]error, len(trackerURLs))
+		var wg sync.WaitGroup
+		for i, trackerURL := range trackerURLs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+				results[i], errs[i] = scrapeTracker(ctx, trackerURL, infoHash)
+			}()
+		}
+		wg.Wait()
+
+		for i, trackerURL := range trackerURLs {
+			fmt.Printf("Tracker: %s\n", trackerURL)
+			if errs[i] != nil {
+				fmt.Printf("  Error: %v\n", errs[i])
+				continue
+			}
+			fmt.Printf("  Seeders: %d\n", results[i].Complete)
+			fmt.Printf("  Leechers: %d\n", results[i].Incomplete)
+			fmt.Printf("  Downloaded: %d\n", results[i].Downloaded)
+		}
+
 	} else if command == "handshake" {
 		fileName := os.Args[2]
 		address := os.Args[3]
 
-		data, err := os.ReadFile(fileName)
-		if err != nil {
-			panic(err)
-		}
-		bencodedString := string(data)
-		decoded, _, err := decodeBencode(bencodedString)
+		meta, err := LoadMetainfo(fileName)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
-		dict, ok := decoded.(map[string]any)
-		if !ok {
-			fmt.Println("Invalid bencoded data")
-			return
-		}
-		info, ok := dict["info"].(map[string]any)
-		if !ok {
-			fmt.Println("Invalid bencoded data")
-			return
-		}
 		conn, err := net.DialTimeout("tcp", address, 30*time.Second)
 		if err != nil {
 			fmt.Println("Error connecting to peer:", err)
 			return
 		}
 		defer conn.Close()
-		encodedInfo := bencodeEncode(info)
-		hash := sha1.Sum([]byte(encodedInfo))
 
 		// Perform handshake
-		err = doHandShake(conn, hash[:])
+		err = doHandShake(conn, meta.InfoHash)
 		if err != nil {
 			fmt.Println("Error during handshake:", err)
 			return
 		}
 		// Read the handshake response
-		res, err := readHandShake(conn)
-		peerID := res[48:68]
+		res, err := readHandShake(conn, meta.InfoHash)
 		if err != nil {
 			fmt.Println("Error reading handshake response:", err)
 			return
 		}
 
-		fmt.Printf("Peer ID: %x\n", peerID)
+		fmt.Printf("Peer ID: %x\n", res.PeerID)
+		fmt.Printf("Client: %s\n", clientName(res.PeerID))
 
 	} else if command == "download_piece" {
 		outputFile := os.Args[3]
@@ -195,46 +177,35 @@ func main() {
 			fmt.Println("Error converting piece index:", err)
 			return
 		}
-		data, err := os.ReadFile(fileName)
-		if err != nil {
-			panic(err)
-		}
-		bencodedString := string(data)
-		decoded, _, err := decodeBencode(bencodedString)
+		meta, err := LoadMetainfo(fileName)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
-		dict, ok := decoded.(map[string]any)
-		if !ok {
-			fmt.Println("Invalid bencoded data")
-			return
-		}
-		info, ok := dict["info"].(map[string]any)
-		if !ok {
-			fmt.Println("Invalid bencoded data")
-			return
-		}
-		peerList, err := getPeers(dict["announce"].(string), info)
+		peerList, err := meta.Trackers().announce(func(trackerURL string) ([]Peer, error) {
+			return getPeers(trackerURL, meta.InfoHash, meta.Info.TotalLength(), lookupPort)
+		})
 		if err != nil {
 			fmt.Println("Error getting peers:", err)
 			return
 		}
+		if len(peerList) == 0 {
+			fmt.Println("No peers available")
+			return
+		}
 		// Connect to the first peer
-		conn, err := net.DialTimeout("tcp", peerList[0], 30*time.Second)
+		conn, err := net.DialTimeout("tcp", peerList[0].String(), 30*time.Second)
 		if err != nil {
 			fmt.Println("Error connecting to peer:", err)
 			return
 		}
 		defer conn.Close()
-		encodedInfo := bencodeEncode(info)
-		hash := sha1.Sum([]byte(encodedInfo))
-		err = doHandShake(conn, hash[:])
+		err = doHandShake(conn, meta.InfoHash)
 		if err != nil {
 			fmt.Println("Error during handshake:", err)
 			return
 		}
-		_, err = readHandShake(conn)
+		_, err = readHandShake(conn, meta.InfoHash)
 		if err != nil {
 			fmt.Println("Error reading handshake response:", err)
 			return
@@ -255,71 +226,14 @@ func main() {
 			fmt.Println("Error reading unchoke message:", err)
 			return
 		}
-		pieceLength := int(info["piece length"].(int))
-		// right after you fetch pieceLength from info
-		totalLength := int(info["length"].(int))
-		numPieces := (totalLength + pieceLength - 1) / pieceLength
-
-		if pieceIndex == numPieces-1 {
-			remaining := totalLength % pieceLength
-			if remaining != 0 {
-				pieceLength = remaining
-			}
-		}
-
-		begin := 0
-
-		for begin < pieceLength {
-			blockLen := BlockSize
-			if begin+blockLen > pieceLength {
-				blockLen = pieceLength - begin
-			}
-			err := sendRequest(conn, pieceIndex, begin, blockLen)
-			if err != nil {
-				fmt.Printf("Failed to send request: %v\n", err)
-				return
-			}
-			begin += blockLen
+		if pieceIndex < 0 || pieceIndex >= meta.Info.NumPieces() {
+			fmt.Println("Piece index out of range:", pieceIndex)
+			return
 		}
-
-		pieceBuffer := make([]byte, pieceLength)
-		blocksReceived := 0
-
-		for blocksReceived < pieceLength {
-			// Read message length
-			lengthBuf := make([]byte, 4)
-			_, err := io.ReadFull(conn, lengthBuf)
-			if err != nil {
-				fmt.Println("Failed to read message length:", err)
-				return
-			}
-			length := binary.BigEndian.Uint32(lengthBuf)
-
-			// Read full message
-			payload := make([]byte, length)
-			_, err = io.ReadFull(conn, payload)
-			if err != nil {
-				fmt.Println("Failed to read message payload:", err)
-				return
-			}
-
-			if payload[0] != 7 {
-				// Not a piece message, skip or handle
-				continue
-			}
-
-			index := binary.BigEndian.Uint32(payload[1:5])
-			begin := binary.BigEndian.Uint32(payload[5:9])
-			block := payload[9:]
-
-			if int(index) != pieceIndex {
-				fmt.Println("Received block for wrong piece, skipping")
-				continue
-			}
-
-			copy(pieceBuffer[begin:], block)
-			blocksReceived += len(block)
-
+		pieceBuffer, err := downloadPiece(conn, pieceIndex, meta.Info)
+		if err != nil {
+			fmt.Println("Failed to download piece:", err)
+			return
 		}
 
 		err = os.WriteFile(outputFile, pieceBuffer, 0644)
@@ -330,7 +244,7 @@ func main() {
 		fmt.Println("Piece downloaded and saved successfully.")
 
 		// validate piece
-		ifValidPiece := checkIntegrity(pieceBuffer, pieceIndex, info)
+		ifValidPiece := checkIntegrity(pieceBuffer, pieceIndex, meta.Info)
 		if ifValidPiece {
 			fmt.Println("Piece integrity check passed.")
 		} else {
@@ -341,125 +255,186 @@ func main() {
 		outputFile := os.Args[3]
 		fileName := os.Args[4]
 
-		data, err := os.ReadFile(fileName)
+		meta, err := LoadMetainfo(fileName)
 		if err != nil {
-			panic(err)
+			fmt.Println(err)
+			return
 		}
-		bencodedString := string(data)
-		decoded, _, err := decodeBencode(bencodedString)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		info := meta.Info
+		storageKind := ""
+		if len(os.Args) > 5 {
+			storageKind = os.Args[5]
+		}
+		download, err := openDownload(ctx, outputFile, storageKind, meta.InfoHash, info)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Println("Failed to open download:", err)
 			return
 		}
-		dict, ok := decoded.(map[string]any)
-		if !ok {
-			fmt.Println("Invalid bencoded data")
+		if have := info.NumPieces() - int(download.remaining.Load()); have > 0 {
+			fmt.Printf("Resuming with %d/%d pieces\n", have, info.NumPieces())
+		}
+		listener, err := sharedListener()
+		if err != nil {
+			fmt.Println("Error listening for peers:", err)
 			return
 		}
-		info, ok := dict["info"].(map[string]any)
-		if !ok {
-			fmt.Println("Invalid bencoded data")
+		listener.add(download.seed)
+		stopListening := listener.start(ctx)
+		peers := make(chan Peer)
+		stopAnnouncers := startAnnouncers(ctx, []*trackerTiers{meta.Trackers()}, meta.InfoHash, listener.Port(), download, peers)
+		err = download.run(peers)
+		stopAnnouncers()
+		// inbound peers read from the storage, so they go before it closes
+		stopListening()
+		// progress is saved even when interrupted, to resume from later
+		if err := download.close(outputFile, storageKind); err != nil {
+			fmt.Println("Failed to save download:", err)
 			return
 		}
-		peerList, err := getPeers(dict["announce"].(string), info)
 		if err != nil {
-			fmt.Println("Error getting peers:", err)
+			fmt.Println("Download interrupted:", err)
 			return
 		}
+		fmt.Println("Download completed successfully.")
 
-		numPieces := int(info["length"].(int)) / int(info["piece length"].(int))
-		if int(info["length"].(int))%int(info["piece length"].(int)) != 0 {
-			numPieces++
-		}
-		pieceLength := int(info["piece length"].(int))
-		totalLength := int(info["length"].(int))
-		piecesStr := info["pieces"].(string)
-		bytesPieces := []byte(piecesStr)
-		hashes := make([]string, numPieces)
-		for i := 0; i < len(bytesPieces); i += 20 {
-			pieceHash := bytesPieces[i : i+20]
-			hashes[i/20] = hex.EncodeToString(pieceHash)
+	} else if command == "seed" {
+		fileName := os.Args[2]
+		dataPath := os.Args[3]
+
+		meta, err := LoadMetainfo(fileName)
+		if err != nil {
+			fmt.Println(err)
+			return
 		}
-		tasks := make(chan PieceTask, numPieces)
-		for i := 0; i < numPieces; i++ {
-			size := pieceLength
-			if i == numPieces-1 && totalLength%pieceLength != 0 {
-				size = totalLength % pieceLength
+		layout := newFileLayout(dataPath, meta.Info)
+		layout.readOnly = true
+		defer layout.Close()
+
+		have := verifyPieces(meta.Info, layout)
+		verified := 0
+		for i := 0; i < meta.Info.NumPieces(); i++ {
+			if have.Has(i) {
+				verified++
 			}
-			var hash [20]byte
-			copy(hash[:], []byte(hashes[i]))
+		}
+		fmt.Printf("Verified %d/%d pieces\n", verified, meta.Info.NumPieces())
+		if verified == 0 {
+			fmt.Println("No verified data to seed")
+			return
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		torrent := newSeedTorrent(meta.InfoHash, meta.Info, layout, have)
+		listener, err := sharedListener()
+		if err != nil {
+			fmt.Println("Error listening for peers:", err)
+			return
+		}
+		listener.add(torrent)
+		go torrent.choker.run(ctx)
 
-			tasks <- PieceTask{Index: i, Hash: hash, Size: size}
+		// a seed has no use for the peers trackers return
+		peers := make(chan Peer)
+		go func() {
+			for range peers {
+			}
+		}()
+		stopAnnouncers := startAnnouncers(ctx, []*trackerTiers{meta.Trackers()}, meta.InfoHash, listener.Port(), torrent, peers)
+		fmt.Printf("Seeding on port %d\n", listener.Port())
+		err = listener.serve(ctx)
+		stopAnnouncers()
+		if err != nil {
+			fmt.Println("Error accepting peers:", err)
+			return
 		}
-		close(tasks)
-		buffer := make([][]byte, totalLength)
-		var wg sync.WaitGroup
-		for _, peer := range peerList {
-			wg.Add(1)
-			go func(peerAddr string) {
-				defer wg.Done()
+		fmt.Printf("Uploaded %d bytes\n", torrent.uploaded.Load())
+
+	} else if command == "verify" {
+		fileName := os.Args[2]
+		dataPath := os.Args[3]
+		asJSON := len(os.Args) > 4 && os.Args[4] == "--json"
 
-				err := handlePeer(peerAddr, tasks, buffer, info)
-				if err != nil {
-					fmt.Println("Worker failed:", err)
-				}
-			}(peer)
+		meta, err := LoadMetainfo(fileName)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		report := verifyData(meta, dataPath)
+		if asJSON {
+			if err := report.printJSON(os.Stdout); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		} else {
+			report.print(os.Stdout)
+		}
+		if !report.OK {
+			os.Exit(1)
 		}
-		wg.Wait()
-		// Merge buffer and save to disk
-		out := bytes.Join(buffer, nil)
-		os.WriteFile(outputFile, out, 0644)
-		fmt.Println("Download completed successfully.")
 
 	} else if command == "magnet_parse" {
-		magnetLink := os.Args[2]
-		params, _ := url.ParseQuery(magnetLink[8:])
+		magnet, err := ParseMagnet(os.Args[2])
+		if err != nil {
+			fmt.Println("Invalid magnet link:", err)
+			return
+		}
 
-		fmt.Printf("Tracker URL: %s\nInfo Hash: %s\n", params["tr"][0], params["xt"][0][9:])
+		for _, trackerURL := range magnet.Trackers {
+			fmt.Printf("Tracker URL: %s\n", trackerURL)
+		}
+		fmt.Printf("Info Hash: %x\n", magnet.InfoHash)
 	} else if command == "magnet_handshake" {
 		magnetLink := os.Args[2]
 
-		params, _ := url.ParseQuery(magnetLink[8:])
-		trackerURL := params["tr"][0]
-		infoHashHex := params["xt"][0][9:]
-		decodedHash, _ := hex.DecodeString(infoHashHex)
-		var infoHash [20]byte
-		copy(infoHash[:], decodedHash)
-		peerList, err := getPeersFromMagnet(trackerURL, infoHash[:])
+		magnet, err := ParseMagnet(magnetLink)
+		if err != nil {
+			fmt.Println("Invalid magnet link:", err)
+			return
+		}
+		infoHash := magnet.InfoHash
+		peerList, err := getPeersFromTrackers(magnet.Trackers, func(trackerURL string) ([]Peer, error) {
+			return getPeers(trackerURL, infoHash, unknownLeft, lookupPort)
+		})
 		if err != nil {
 			fmt.Println("Error getting peers:", err)
 			return
 		}
+		if len(peerList) == 0 {
+			fmt.Println("No peers available")
+			return
+		}
 		// Connect to the first peer
-		conn, err := net.DialTimeout("tcp", peerList[0], 30*time.Second)
+		conn, err := net.DialTimeout("tcp", peerList[0].String(), 30*time.Second)
 		if err != nil {
 			fmt.Println("Error connecting to peer:", err)
 			return
 		}
 		defer conn.Close()
 		// Perform handshake
-		err = doMagnetHandShake(conn, infoHash[:])
+		err = doMagnetHandShake(conn, infoHash)
 		if err != nil {
 			fmt.Println("Error during handshake:", err)
 			return
 		}
 		// Read the handshake response
-		res, err := readHandShake(conn)
+		res, err := readHandShake(conn, infoHash)
 		if err != nil {
 			fmt.Println("Error reading handshake response:", err)
 			return
 		}
-		peerID := res[48:68]
 		_, err = readBitfield(conn)
 		if err != nil {
 			fmt.Println("Error reading bitfield:", err)
 			return
 		}
-		fmt.Printf("Peer ID: %x\n", peerID)
-		// check if extension is supported
-		extensionReservedByte := res[25]
-		if extensionReservedByte != 16 {
-			fmt.Println("Peer doesnt support extensions:", err)
+		fmt.Printf("Peer ID: %x\n", res.PeerID)
+		if !res.Capabilities().Extensions {
+			fmt.Println("Peer doesn't support extensions")
 			return
 		}
 
@@ -468,42 +443,47 @@ func main() {
 			fmt.Println("Error during handshake:", err)
 		}
 
-		_, _, header, err := readExtensionMessage(conn)
+		extHandshake, err := readExtensionHandshake(conn)
 		if err != nil {
 			fmt.Println("Error reading handshake response:", err)
 			return
 		}
-		m := header["m"].(map[string]any)
-		fmt.Printf("Peer Metadata Extension ID: %v\n", m["ut_metadata"])
+		fmt.Printf("Peer Metadata Extension ID: %v\n", extHandshake.M["ut_metadata"])
 
 	} else if command == "magnet_info" {
 		magnetLink := os.Args[2]
-		params, _ := url.ParseQuery(magnetLink[8:])
-		trackerURL := params["tr"][0]
-		infoHashHex := params["xt"][0][9:]
-		decodedHash, _ := hex.DecodeString(infoHashHex)
-		var infoHash [20]byte
-		copy(infoHash[:], decodedHash)
-		peerList, err := getPeersFromMagnet(trackerURL, infoHash[:])
+		magnet, err := ParseMagnet(magnetLink)
+		if err != nil {
+			fmt.Println("Invalid magnet link:", err)
+			return
+		}
+		infoHash := magnet.InfoHash
+		peerList, err := getPeersFromTrackers(magnet.Trackers, func(trackerURL string) ([]Peer, error) {
+			return getPeers(trackerURL, infoHash, unknownLeft, lookupPort)
+		})
 		if err != nil {
 			fmt.Println("Error getting peers:", err)
 			return
 		}
+		if len(peerList) == 0 {
+			fmt.Println("No peers available")
+			return
+		}
 		// Connect to the first peer
-		conn, err := net.DialTimeout("tcp", peerList[0], 30*time.Second)
+		conn, err := net.DialTimeout("tcp", peerList[0].String(), 30*time.Second)
 		if err != nil {
 			fmt.Println("Error connecting to peer:", err)
 			return
 		}
 		defer conn.Close()
 		// Perform handshake
-		err = doMagnetHandShake(conn, infoHash[:])
+		err = doMagnetHandShake(conn, infoHash)
 		if err != nil {
 			fmt.Println("Error during handshake:", err)
 			return
 		}
 		// Read the handshake response
-		res, err := readHandShake(conn)
+		res, err := readHandShake(conn, infoHash)
 		if err != nil {
 			fmt.Println("Error reading handshake response:", err)
 			return
@@ -513,25 +493,26 @@ func main() {
 			fmt.Println("Error reading bitfield:", err)
 			return
 		}
-		// check if extension is supported
-		extensionReservedByte := res[25]
-		if extensionReservedByte != 16 {
-			fmt.Println("Peer doesnt support extensions:", err)
+		if !res.Capabilities().Extensions {
+			fmt.Println("Peer doesn't support extensions")
 			return
 		}
 		err = sendExtensionHandshake(conn)
 		if err != nil {
 			fmt.Println("Error during handshake:", err)
 		}
-		_, _, header, err := readExtensionMessage(conn)
+		extHandshake, err := readExtensionHandshake(conn)
 		if err != nil {
 			fmt.Println("Error reading handshake response:", err)
 			return
 		}
-		m := header["m"].(map[string]any)
 
 		// send metadata request
-		metaExtID := m["ut_metadata"].(int)
+		metaExtID, ok := extHandshake.M["ut_metadata"]
+		if !ok {
+			fmt.Println("Peer doesn't support metadata exchange")
+			return
+		}
 
 		err = sendMetadataRequest(conn, 0, byte(metaExtID))
 		if err != nil {
@@ -539,25 +520,22 @@ func main() {
 			return
 		}
 		// Read metadata response
-		metadata, err := readMetadataResponse(conn)
+		metadata, err := readMetadataResponse(conn, infoHash)
 		if err != nil {
 			fmt.Println("Error reading metadata response:", err)
 			return
 		}
 
 		info := metadata
-		encodedInfo := bencodeEncode(info)
-		hash := sha1.Sum([]byte(encodedInfo))
-		fmt.Printf("Tracker URL: %s\n", trackerURL)
-		fmt.Printf("Length: %d\n", info["length"])
-		fmt.Printf("Info Hash: %x\n", hash)
-		fmt.Printf("Piece Length: %d\n", info["piece length"])
+		for _, trackerURL := range magnet.Trackers {
+			fmt.Printf("Tracker URL: %s\n", trackerURL)
+		}
+		fmt.Printf("Length: %d\n", info.TotalLength())
+		fmt.Printf("Info Hash: %x\n", infoHash)
+		fmt.Printf("Piece Length: %d\n", info.PieceLength)
 		fmt.Printf("Piece Hashes:\n")
-		piecesStr := info["pieces"].(string)
-		bytesPieces := []byte(piecesStr)
-		for i := 0; i < len(bytesPieces); i += 20 {
-			pieceHash := bytesPieces[i : i+20]
-			fmt.Println(hex.EncodeToString(pieceHash))
+		for _, pieceHash := range info.Pieces {
+			fmt.Println(hex.EncodeToString(pieceHash[:]))
 		}
 	} else if command == "magnet_download_piece" {
 		magnetLink := os.Args[4]
@@ -568,32 +546,38 @@ func main() {
 		}
 		outputFile := os.Args[3]
 
-		params, _ := url.ParseQuery(magnetLink[8:])
-		trackerURL := params["tr"][0]
-		infoHashHex := params["xt"][0][9:]
-		decodedHash, _ := hex.DecodeString(infoHashHex)
-		var infoHash [20]byte
-		copy(infoHash[:], decodedHash)
-		peerList, err := getPeersFromMagnet(trackerURL, infoHash[:])
+		magnet, err := ParseMagnet(magnetLink)
+		if err != nil {
+			fmt.Println("Invalid magnet link:", err)
+			return
+		}
+		infoHash := magnet.InfoHash
+		peerList, err := getPeersFromTrackers(magnet.Trackers, func(trackerURL string) ([]Peer, error) {
+			return getPeers(trackerURL, infoHash, unknownLeft, lookupPort)
+		})
 		if err != nil {
 			fmt.Println("Error getting peers:", err)
 			return
 		}
+		if len(peerList) == 0 {
+			fmt.Println("No peers available")
+			return
+		}
 		// Connect to the first peer
-		conn, err := net.DialTimeout("tcp", peerList[0], 30*time.Second)
+		conn, err := net.DialTimeout("tcp", peerList[0].String(), 30*time.Second)
 		if err != nil {
 			fmt.Println("Error connecting to peer:", err)
 			return
 		}
 		defer conn.Close()
 		// Perform handshake
-		err = doMagnetHandShake(conn, infoHash[:])
+		err = doMagnetHandShake(conn, infoHash)
 		if err != nil {
 			fmt.Println("Error during handshake:", err)
 			return
 		}
 		// Read the handshake response
-		res, err := readHandShake(conn)
+		res, err := readHandShake(conn, infoHash)
 		if err != nil {
 			fmt.Println("Error reading handshake response:", err)
 			return
@@ -604,10 +588,8 @@ func main() {
 			fmt.Println("Error reading bitfield:", err)
 			return
 		}
-		// check if extension is supported
-		extensionReservedByte := res[25]
-		if extensionReservedByte != 16 {
-			fmt.Println("Peer doesnt support extensions:", err)
+		if !res.Capabilities().Extensions {
+			fmt.Println("Peer doesn't support extensions")
 			return
 		}
 		err = sendExtensionHandshake(conn)
@@ -615,20 +597,23 @@ func main() {
 			fmt.Println("Error during handshake:", err)
 			return
 		}
-		_, _, header, err := readExtensionMessage(conn)
+		extHandshake, err := readExtensionHandshake(conn)
 		if err != nil {
 			fmt.Println("Error reading handshake response:", err)
 			return
 		}
-		m := header["m"].(map[string]any)
-		metaExtID := m["ut_metadata"].(int)
+		metaExtID, ok := extHandshake.M["ut_metadata"]
+		if !ok {
+			fmt.Println("Peer doesn't support metadata exchange")
+			return
+		}
 		err = sendMetadataRequest(conn, 0, byte(metaExtID))
 		if err != nil {
 			fmt.Println("Error sending metadata request:", err)
 			return
 		}
 		// Read metadata response
-		metadata, err := readMetadataResponse(conn)
+		metadata, err := readMetadataResponse(conn, infoHash)
 		if err != nil {
 			fmt.Println("Error reading metadata response:", err)
 			return
@@ -644,66 +629,14 @@ func main() {
 			fmt.Println("Error reading unchoke message:", err)
 			return
 		}
-		pieceLength := int(info["piece length"].(int))
-		// right after you fetch pieceLength from info
-		totalLength := int(info["length"].(int))
-		numPieces := (totalLength + pieceLength - 1) / pieceLength
-		if pieceIndex == numPieces-1 {
-			remaining := totalLength % pieceLength
-			if remaining != 0 {
-				pieceLength = remaining
-			}
+		if pieceIndex < 0 || pieceIndex >= info.NumPieces() {
+			fmt.Println("Piece index out of range:", pieceIndex)
+			return
 		}
-		begin := 0
-		for begin < pieceLength {
-			blockLen := BlockSize
-			if begin+blockLen > pieceLength {
-				blockLen = pieceLength - begin
-			}
-			err := sendRequest(conn, pieceIndex, begin, blockLen)
-			if err != nil {
-				fmt.Printf("Failed to send request: %v\n", err)
-				return
-			}
-			begin += blockLen
-		}
-		pieceBuffer := make([]byte, pieceLength)
-		blocksReceived := 0
-		for blocksReceived < pieceLength {
-			// Read message length
-			lengthBuf := make([]byte, 4)
-			_, err := io.ReadFull(conn, lengthBuf)
-			if err != nil {
-				fmt.Println("Failed to read message length:", err)
-				return
-			}
-			length := binary.BigEndian.Uint32(lengthBuf)
-
-			// Read full message
-			payload := make([]byte, length)
-			_, err = io.ReadFull(conn, payload)
-			if err != nil {
-				fmt.Println("Failed to read message payload:", err)
-				return
-			}
-
-			if payload[0] != 7 {
-				// Not a piece message, skip or handle
-				continue
-			}
-
-			index := binary.BigEndian.Uint32(payload[1:5])
-			begin := binary.BigEndian.Uint32(payload[5:9])
-			block := payload[9:]
-
-			if int(index) != pieceIndex {
-				fmt.Println("Received block for wrong piece, skipping")
-				continue
-			}
-
-			copy(pieceBuffer[begin:], block)
-			blocksReceived += len(block)
-
+		pieceBuffer, err := downloadPiece(conn, pieceIndex, info)
+		if err != nil {
+			fmt.Println("Failed to download piece:", err)
+			return
 		}
 		err = os.WriteFile(outputFile, pieceBuffer, 0644)
 		if err != nil {
@@ -721,30 +654,41 @@ func main() {
 		outputFile := os.Args[3]
 		magnetLink := os.Args[4]
 
-		params, _ := url.ParseQuery(magnetLink[8:])
-		infoHashHex := params["xt"][0][9:]
-		decodedHash, _ := hex.DecodeString(infoHashHex)
-		var infoHash [20]byte
-		copy(infoHash[:], decodedHash)
-		trackerURL := params["tr"][0]
+		magnet, err := ParseMagnet(magnetLink)
+		if err != nil {
+			fmt.Println("Invalid magnet link:", err)
+			return
+		}
+		infoHash := magnet.InfoHash
+		listener, err := sharedListener()
+		if err != nil {
+			fmt.Println("Error listening for peers:", err)
+			return
+		}
 
-		peerList, err := getPeersFromMagnet(trackerURL, infoHash[:])
+		peerList, err := getPeersFromTrackers(magnet.Trackers, func(trackerURL string) ([]Peer, error) {
+			return getPeers(trackerURL, infoHash, unknownLeft, listener.Port())
+		})
 		if err != nil {
 			fmt.Println("Error getting peers:", err)
 			return
 		}
+		if len(peerList) == 0 {
+			fmt.Println("No peers available")
+			return
+		}
 
-		conn, err := net.DialTimeout("tcp", peerList[0], 10*time.Second)
+		conn, err := net.DialTimeout("tcp", peerList[0].String(), 10*time.Second)
 		if err != nil {
 			fmt.Println("Error connecting to peer:", err)
 			return
 		}
 
-		if err = doMagnetHandShake(conn, infoHash[:]); err != nil {
+		if err = doMagnetHandShake(conn, infoHash); err != nil {
 			fmt.Println("Handshake failed:", err)
 			return
 		}
-		handshake, err := readHandShake(conn)
+		handshake, err := readHandShake(conn, infoHash)
 		if err != nil {
 			fmt.Println("Error reading handshake:", err)
 			return
@@ -754,7 +698,7 @@ func main() {
 			return
 		}
 
-		if handshake[25] != 0x10 {
+		if !handshake.Capabilities().Extensions {
 			fmt.Println("Peer doesn't support extensions")
 			return
 		}
@@ -763,68 +707,106 @@ func main() {
 			fmt.Println("Extension handshake failed:", err)
 			return
 		}
-		_, _, header, err := readExtensionMessage(conn)
+		extHandshake, err := readExtensionHandshake(conn)
 		if err != nil {
 			fmt.Println("Error reading extension message:", err)
 			return
 		}
-		metaExtID := header["m"].(map[string]any)["ut_metadata"].(int)
+		metaExtID, ok := extHandshake.M["ut_metadata"]
+		if !ok {
+			fmt.Println("Peer doesn't support metadata exchange")
+			return
+		}
 
 		if err = sendMetadataRequest(conn, 0, byte(metaExtID)); err != nil {
 			fmt.Println("Metadata request failed:", err)
 			return
 		}
-		info, err := readMetadataResponse(conn)
+		info, err := readMetadataResponse(conn, infoHash)
 		if err != nil {
 			fmt.Println("Error reading metadata:", err)
 			return
 		}
 		conn.Close()
 
-		numPieces := int(info["length"].(int)) / int(info["piece length"].(int))
-		if int(info["length"].(int))%int(info["piece length"].(int)) != 0 {
-			numPieces++
-		}
-		pieceLength := int(info["piece length"].(int))
-		totalLength := int(info["length"].(int))
-		piecesStr := info["pieces"].(string)
-		bytesPieces := []byte(piecesStr)
-		hashes := make([]string, numPieces)
-		for i := 0; i < len(bytesPieces); i += 20 {
-			pieceHash := bytesPieces[i : i+20]
-			hashes[i/20] = hex.EncodeToString(pieceHash)
-		}
-		tasks := make(chan PieceTask, numPieces)
-		for i := 0; i < numPieces; i++ {
-			size := pieceLength
-			if i == numPieces-1 && totalLength%pieceLength != 0 {
-				size = totalLength % pieceLength
-			}
-			var hash [20]byte
-			copy(hash[:], []byte(hashes[i]))
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
 
-			tasks <- PieceTask{Index: i, Hash: hash, Size: size}
+		storageKind := ""
+		if len(os.Args) > 5 {
+			storageKind = os.Args[5]
 		}
-		close(tasks)
-		buffer := make([][]byte, totalLength)
-		var wg sync.WaitGroup
+		download, err := openDownload(ctx, outputFile, storageKind, infoHash, info)
+		if err != nil {
+			fmt.Println("Failed to open download:", err)
+			return
+		}
+		if have := info.NumPieces() - int(download.remaining.Load()); have > 0 {
+			fmt.Printf("Resuming with %d/%d pieces\n", have, info.NumPieces())
+		}
+		listener.add(download.seed)
+		stopListening := listener.start(ctx)
 		for _, peer := range peerList {
-			wg.Add(1)
-			go func(peerAddr string) {
-				defer wg.Done()
-
-				err := handlePeer(peerAddr, tasks, buffer, info)
-				if err != nil {
-					fmt.Println("Worker failed:", err)
-				}
-			}(peer)
+			download.addPeer(peer)
+		}
+		// every tracker of a magnet link is announced to independently
+		var tierSets []*trackerTiers
+		for _, trackerURL := range magnet.Trackers {
+			tierSets = append(tierSets, newTrackerTiers(trackerURL, nil))
+		}
+		peers := make(chan Peer)
+		stopAnnouncers := startAnnouncers(ctx, tierSets, infoHash, listener.Port(), download, peers)
+		err = download.run(peers)
+		stopAnnouncers()
+		// inbound peers read from the storage, so they go before it closes
+		stopListening()
+		// progress is saved even when interrupted, to resume from later
+		if err := download.close(outputFile, storageKind); err != nil {
+			fmt.Println("Failed to save download:", err)
+			return
+		}
+		if err != nil {
+			fmt.Println("Download interrupted:", err)
+			return
 		}
-		wg.Wait()
-		// Merge buffer and save to disk
-		out := bytes.Join(buffer, nil)
-		os.WriteFile(outputFile, out, 0644)
 		fmt.Println("Download completed successfully.")
 
+	} else if command == "tracker" {
+		address := ":6969"
+		if len(os.Args) > 2 {
+			address = os.Args[2]
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		tracker := newTrackerServer()
+		go tracker.sweepLoop(ctx)
+		server := &http.Server{Addr: address, Handler: tracker}
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			server.Shutdown(shutdownCtx)
+		}()
+
+		udpConn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			fmt.Println("Tracker failed:", err)
+			os.Exit(1)
+		}
+		go func() {
+			if err := tracker.serveUDP(ctx, udpConn); err != nil {
+				fmt.Println("UDP tracker failed:", err)
+			}
+		}()
+
+		fmt.Printf("Tracker listening on %s (HTTP and UDP)\n", address)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Println("Tracker failed:", err)
+			os.Exit(1)
+		}
+
 	} else {
 		fmt.Println("Unknown command: " + command)
 		os.Exit(1)
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MessageID identifies a peer wire message.
+type MessageID uint8
+
+const (
+	MsgChoke         MessageID = 0
+	MsgUnchoke       MessageID = 1
+	MsgInterested    MessageID = 2
+	MsgNotInterested MessageID = 3
+	MsgHave          MessageID = 4
+	MsgBitfield      MessageID = 5
+	MsgRequest       MessageID = 6
+	MsgPiece         MessageID = 7
+	MsgCancel        MessageID = 8
+	MsgPort          MessageID = 9
+	MsgExtended      MessageID = 20
+)
+
+func (id MessageID) String() string {
+	switch id {
+	case MsgChoke:
+		return "choke"
+	case MsgUnchoke:
+		return "unchoke"
+	case MsgInterested:
+		return "interested"
+	case MsgNotInterested:
+		return "not interested"
+	case MsgHave:
+		return "have"
+	case MsgBitfield:
+		return "bitfield"
+	case MsgRequest:
+		return "request"
+	case MsgPiece:
+		return "piece"
+	case MsgCancel:
+		return "cancel"
+	case MsgPort:
+		return "port"
+	case MsgExtended:
+		return "extended"
+	}
+	return fmt.Sprintf("message %d", uint8(id))
+}
+
+// maxMessageSize bounds the length prefix accepted by ReadMessage. It
+// leaves room for a 16 KiB block and for the bitfield of a torrent with
+// millions of pieces.
+const maxMessageSize = 1 << 20
+
+// ErrMessageTooLarge is returned for a message longer than maxMessageSize.
+var ErrMessageTooLarge = errors.New("peer message too large")
+
+// Message is a peer wire message. A nil *Message is a keep-alive.
+type Message struct {
+	ID      MessageID
+	Payload []byte
+}
+
+// ReadMessage reads one length-prefixed message. It returns a nil message
+// for a keep-alive.
+func ReadMessage(r io.Reader) (*Message, error) {
+	var lengthBuf [4]byte
+	if _, err := io.ReadFull(r, lengthBuf[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthBuf[:])
+	if length == 0 {
+		return nil, nil
+	}
+	if length > maxMessageSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return &Message{ID: MessageID(buf[0]), Payload: buf[1:]}, nil
+}
+
+// WriteTo writes the message with its length prefix.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	var buf []byte
+	if m == nil {
+		buf = make([]byte, 4)
+	} else {
+		buf = make([]byte, 5, 5+len(m.Payload))
+		binary.BigEndian.PutUint32(buf[0:4], uint32(1+len(m.Payload)))
+		buf[4] = byte(m.ID)
+		buf = append(buf, m.Payload...)
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func (m *Message) String() string {
+	if m == nil {
+		return "keep-alive"
+	}
+	return m.ID.String()
+}
+
+func NewHave(index int) *Message {
+	return &Message{ID: MsgHave, Payload: binary.BigEndian.AppendUint32(nil, uint32(index))}
+}
+
+func NewBitfield(bitfield []byte) *Message {
+	return &Message{ID: MsgBitfield, Payload: bitfield}
+}
+
+func NewRequest(index, begin, length int) *Message {
+	return &Message{ID: MsgRequest, Payload: blockPayload(index, begin, length)}
+}
+
+func NewCancel(index, begin, length int) *Message {
+	return &Message{ID: MsgCancel, Payload: blockPayload(index, begin, length)}
+}
+
+func NewPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	return &Message{ID: MsgPiece, Payload: append(payload, block...)}
+}
+
+// NewExtended builds a BEP 10 message; extID 0 is the extension handshake.
+func NewExtended(extID byte, payload []byte) *Message {
+	return &Message{ID: MsgExtended, Payload: append([]byte{extID}, payload...)}
+}
+
+func blockPayload(index, begin, length int) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return payload
+}
+
+func (m *Message) check(id MessageID, size int) error {
+	if m.ID != id {
+		return fmt.Errorf("expected %s message, got %s", id, m.ID)
+	}
+	if len(m.Payload) < size {
+		return fmt.Errorf("%s message too short: %d bytes", id, len(m.Payload))
+	}
+	return nil
+}
+
+// ParseHave returns the piece index of a have message.
+func (m *Message) ParseHave() (int, error) {
+	if err := m.check(MsgHave, 4); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(m.Payload)), nil
+}
+
+// ParseRequest returns the block of a request or cancel message.
+func (m *Message) ParseRequest() (index, begin, length int, err error) {
+	id := MsgRequest
+	if m.ID == MsgCancel {
+		id = MsgCancel
+	}
+	if err = m.check(id, 12); err != nil {
+		return
+	}
+	index = int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(m.Payload[8:12]))
+	return
+}
+
+// ParsePiece returns the location and data of a piece message.
+func (m *Message) ParsePiece() (index, begin int, block []byte, err error) {
+	if err = m.check(MsgPiece, 8); err != nil {
+		return
+	}
+	index = int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	block = m.Payload[8:]
+	return
+}
+
+// ParseExtended returns the extended message ID and payload.
+func (m *Message) ParseExtended() (extID byte, payload []byte, err error) {
+	if err = m.check(MsgExtended, 1); err != nil {
+		return
+	}
+	return m.Payload[0], m.Payload[1:], nil
+}
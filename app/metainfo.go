@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
+)
+
+// Metainfo is the contents of a .torrent file.
+type Metainfo struct {
+	Announce     string
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
+	Encoding     string
+	Info         *Info
+
+	// InfoHash is the SHA-1 of the info dictionary exactly as it appears in
+	// the file, which is what peers and trackers know the torrent by.
+	InfoHash [20]byte
+}
+
+// Info is the info dictionary of a torrent. Single-file torrents set Length;
+// multi-file torrents set Files instead.
+type Info struct {
+	Name        string
+	PieceLength int64
+	Pieces      [][20]byte
+	Length      int64
+	Files       []File
+	Private     bool
+}
+
+// File is one entry of a multi-file torrent, with Path relative to the
+// torrent's root directory.
+type File struct {
+	Length int64
+	Path   []string
+}
+
+type rawMetainfo struct {
+	Announce     string             `bencode:"announce"`
+	AnnounceList [][]string         `bencode:"announce-list"`
+	Comment      string             `bencode:"comment"`
+	CreatedBy    string             `bencode:"created by"`
+	CreationDate int64              `bencode:"creation date"`
+	Encoding     string             `bencode:"encoding"`
+	Info         bencode.RawMessage `bencode:"info"`
+}
+
+type rawInfo struct {
+	Name        string    `bencode:"name"`
+	PieceLength int64     `bencode:"piece length"`
+	Pieces      []byte    `bencode:"pieces"`
+	Length      *int64    `bencode:"length"`
+	Files       []rawFile `bencode:"files"`
+	Private     int       `bencode:"private"`
+}
+
+type rawFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+// LoadMetainfo reads and parses the .torrent file at path.
+func LoadMetainfo(path string) (*Metainfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseMetainfo(f)
+}
+
+// ParseMetainfo parses a .torrent file from r.
+func ParseMetainfo(r io.Reader) (*Metainfo, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var raw rawMetainfo
+	if err := bencode.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("metainfo: %w", err)
+	}
+	if len(raw.Info) == 0 {
+		return nil, fmt.Errorf("metainfo: missing info dictionary")
+	}
+	if err := bencode.CheckCanonical(raw.Info); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: info dictionary is not canonically encoded:", err)
+	}
+	info, err := ParseInfo(raw.Info)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metainfo{
+		Announce:     raw.Announce,
+		AnnounceList: raw.AnnounceList,
+		Comment:      raw.Comment,
+		CreatedBy:    raw.CreatedBy,
+		Encoding:     raw.Encoding,
+		Info:         info,
+		InfoHash:     sha1.Sum(raw.Info),
+	}
+	if raw.CreationDate != 0 {
+		m.CreationDate = time.Unix(raw.CreationDate, 0)
+	}
+	return m, nil
+}
+
+// ParseInfo parses and validates a bencoded info dictionary, as found in a
+// .torrent file or received from peers via ut_metadata.
+func ParseInfo(data []byte) (*Info, error) {
+	var raw rawInfo
+	if err := bencode.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("metainfo: info: %w", err)
+	}
+	if len(raw.Pieces)%20 != 0 {
+		return nil, fmt.Errorf("metainfo: pieces length %d is not a multiple of 20", len(raw.Pieces))
+	}
+	info := &Info{
+		Name:        raw.Name,
+		PieceLength: raw.PieceLength,
+		Pieces:      make([][20]byte, len(raw.Pieces)/20),
+		Private:     raw.Private == 1,
+	}
+	for i := range info.Pieces {
+		copy(info.Pieces[i][:], raw.Pieces[i*20:])
+	}
+	if raw.Length != nil {
+		info.Length = *raw.Length
+	}
+	if raw.Files != nil {
+		info.Files = make([]File, 0, len(raw.Files))
+		for _, f := range raw.Files {
+			info.Files = append(info.Files, File{Length: f.Length, Path: f.Path})
+		}
+	}
+	if raw.Length != nil && raw.Files != nil {
+		return nil, fmt.Errorf("metainfo: info has both length and files")
+	}
+	if raw.Length == nil && raw.Files == nil {
+		return nil, fmt.Errorf("metainfo: info has neither length nor files")
+	}
+	if err := info.validate(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// maxPieceLength bounds the piece length we accept. Real torrents use at
+// most a few tens of MiB; whole pieces are held in memory, so a hostile
+// torrent must not be able to ask for more.
+const maxPieceLength = 256 << 20
+
+func (info *Info) validate() error {
+	if !validPathComponent(info.Name) {
+		return fmt.Errorf("metainfo: invalid name %q", info.Name)
+	}
+	if info.PieceLength <= 0 || info.PieceLength > maxPieceLength {
+		return fmt.Errorf("metainfo: invalid piece length %d", info.PieceLength)
+	}
+	if info.Length < 0 {
+		return fmt.Errorf("metainfo: invalid length %d", info.Length)
+	}
+	var total int64
+	for _, f := range info.Files {
+		if f.Length < 0 {
+			return fmt.Errorf("metainfo: invalid length %d for file %v", f.Length, f.Path)
+		}
+		if f.Length > math.MaxInt64-total {
+			return fmt.Errorf("metainfo: total length of files overflows")
+		}
+		total += f.Length
+		if len(f.Path) == 0 {
+			return fmt.Errorf("metainfo: file with empty path")
+		}
+		for _, component := range f.Path {
+			if !validPathComponent(component) {
+				return fmt.Errorf("metainfo: invalid path %q", f.Path)
+			}
+		}
+	}
+	want := info.TotalLength() / info.PieceLength
+	if info.TotalLength()%info.PieceLength != 0 {
+		want++
+	}
+	if int64(len(info.Pieces)) != want {
+		return fmt.Errorf("metainfo: %d piece hashes for %d bytes in %d-byte pieces, want %d",
+			len(info.Pieces), info.TotalLength(), info.PieceLength, want)
+	}
+	return nil
+}
+
+// validPathComponent reports whether name can be used as a single file or
+// directory name without escaping the download directory.
+func validPathComponent(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// IsMultiFile reports whether the torrent describes a directory of files.
+func (info *Info) IsMultiFile() bool {
+	return info.Files != nil
+}
+
+// TotalLength returns the combined size of all files in the torrent.
+func (info *Info) TotalLength() int64 {
+	if !info.IsMultiFile() {
+		return info.Length
+	}
+	var total int64
+	for _, f := range info.Files {
+		total += f.Length
+	}
+	return total
+}
+
+// NumPieces returns the number of pieces in the torrent.
+func (info *Info) NumPieces() int {
+	return len(info.Pieces)
+}
+
+// PieceSize returns the size of piece index; only the last piece may be
+// shorter than the piece length.
+func (info *Info) PieceSize(index int) int {
+	begin := int64(index) * info.PieceLength
+	return int(min(info.PieceLength, info.TotalLength()-begin))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestInfoValidate(t *testing.T) {
+	files := func(lengths ...int64) []File {
+		var fs []File
+		for _, length := range lengths {
+			fs = append(fs, File{Length: length, Path: []string{"f"}})
+		}
+		return fs
+	}
+	tests := []struct {
+		name    string
+		info    Info
+		wantErr bool
+	}{
+		{"single file", Info{Length: 10, PieceLength: 4, Pieces: make([][20]byte, 3)}, false},
+		{"multi-file", Info{Files: files(3, 0, 5), PieceLength: 4, Pieces: make([][20]byte, 2)}, false},
+		{"empty", Info{Length: 0, PieceLength: 4}, false},
+		{"too few pieces", Info{Length: 10, PieceLength: 4, Pieces: make([][20]byte, 2)}, true},
+		{"too many pieces", Info{Length: 8, PieceLength: 4, Pieces: make([][20]byte, 3)}, true},
+		{"negative length", Info{Length: -1, PieceLength: 4}, true},
+		{"negative file length", Info{Files: files(4, -4), PieceLength: 4}, true},
+		{"piece length too large", Info{Length: 10, PieceLength: maxPieceLength + 1, Pieces: make([][20]byte, 1)}, true},
+		{"total wraps to zero", Info{Files: files(1<<62, 1<<62, 1<<62, 1<<62), PieceLength: 4}, true},
+		{"total overflows", Info{Files: files(math.MaxInt64, 1), PieceLength: 4}, true},
+	}
+	for _, tt := range tests {
+		tt.info.Name = "torrent"
+		if err := tt.info.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
+)
+
+// Peer is the address of a peer as reported by a tracker, along with its
+// peer ID when the tracker included one.
+type Peer struct {
+	Addr  netip.AddrPort
+	ID    [20]byte
+	HasID bool
+}
+
+func (p Peer) String() string {
+	return p.Addr.String()
+}
+
+// parseCompactPeers parses a compact peer list of 6-byte IPv4 (BEP 23) or
+// 18-byte IPv6 (BEP 7) entries.
+func parseCompactPeers(b []byte, size int) ([]Peer, error) {
+	if len(b)%size != 0 {
+		return nil, fmt.Errorf("invalid peers data: %d bytes is not a multiple of %d", len(b), size)
+	}
+	var peerList []Peer
+	for i := 0; i < len(b); i += size {
+		ip, _ := netip.AddrFromSlice(b[i : i+size-2])
+		port := binary.BigEndian.Uint16(b[i+size-2 : i+size])
+		peerList = append(peerList, Peer{Addr: netip.AddrPortFrom(ip.Unmap(), port)})
+	}
+	return peerList, nil
+}
+
+type peerDict struct {
+	IP     string `bencode:"ip"`
+	Port   uint16 `bencode:"port"`
+	PeerID []byte `bencode:"peer id,omitempty"`
+}
+
+// parsePeerDicts parses the original, non-compact peer list: a list of
+// dictionaries whose ip may be an IPv4 or IPv6 address or a DNS name.
+// Entries that cannot be resolved are skipped.
+func parsePeerDicts(ctx context.Context, data []byte) ([]Peer, error) {
+	var dicts []peerDict
+	if err := bencode.Unmarshal(data, &dicts); err != nil {
+		return nil, fmt.Errorf("invalid peers list: %w", err)
+	}
+	var peerList []Peer
+	for _, d := range dicts {
+		ip, err := netip.ParseAddr(d.IP)
+		if err != nil {
+			addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", d.IP)
+			if err != nil || len(addrs) == 0 {
+				continue
+			}
+			ip = addrs[0]
+		}
+		peer := Peer{Addr: netip.AddrPortFrom(ip.Unmap(), d.Port)}
+		if len(d.PeerID) == 20 {
+			copy(peer.ID[:], d.PeerID)
+			peer.HasID = true
+		}
+		peerList = append(peerList, peer)
+	}
+	return peerList, nil
+}
+
+// appendCompactPeer appends addr in compact form: 6 bytes for IPv4 and
+// 18 bytes for IPv6.
+func appendCompactPeer(b []byte, addr netip.AddrPort) []byte {
+	b = append(b, addr.Addr().AsSlice()...)
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// peerReadTimeout is how long a peer may stay silent. Peers send
+// keep-alives every two minutes or so.
+const peerReadTimeout = 3 * time.Minute
+
+// Bitfield records which pieces a peer has, high bit first.
+type Bitfield []byte
+
+func newBitfield(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+func (b Bitfield) Has(i int) bool {
+	if i < 0 || i/8 >= len(b) {
+		return false
+	}
+	return b[i/8]&(0x80>>(i%8)) != 0
+}
+
+func (b Bitfield) Set(i int) {
+	if i >= 0 && i/8 < len(b) {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+}
+
+func (b Bitfield) Clear(i int) {
+	if i >= 0 && i/8 < len(b) {
+		b[i/8] &^= 0x80 >> (i % 8)
+	}
+}
+
+// PeerConn is a connection to a peer after the handshake. It tracks the
+// choke and interest state of both sides and the pieces the peer has.
+// PeerConn is not safe for concurrent use.
+type PeerConn struct {
+	conn      net.Conn
+	numPieces int
+
+	amChoking      bool
+	amInterested   bool
+	peerChoking    bool
+	peerInterested bool
+	bitfield       Bitfield
+
+	// knowsPieces is set once a have, bitfield or piece message has
+	// arrived. A bitfield must come before any of them, though other
+	// messages such as the extension handshake may precede it.
+	knowsPieces bool
+}
+
+// newPeerConn starts both sides choked and uninterested, as the protocol
+// requires. Until the peer sends a bitfield or have messages it is assumed
+// to have nothing.
+func newPeerConn(conn net.Conn, numPieces int) *PeerConn {
+	return &PeerConn{
+		conn:        conn,
+		numPieces:   numPieces,
+		amChoking:   true,
+		peerChoking: true,
+		bitfield:    newBitfield(numPieces),
+	}
+}
+
+func (p *PeerConn) AmChoking() bool      { return p.amChoking }
+func (p *PeerConn) AmInterested() bool   { return p.amInterested }
+func (p *PeerConn) PeerChoking() bool    { return p.peerChoking }
+func (p *PeerConn) PeerInterested() bool { return p.peerInterested }
+
+// Has reports whether the peer has piece i.
+func (p *PeerConn) Has(i int) bool {
+	return p.bitfield.Has(i)
+}
+
+func (p *PeerConn) Send(msg *Message) error {
+	_, err := msg.WriteTo(p.conn)
+	return err
+}
+
+// SetInterested tells the peer whether we want any of its pieces, if that
+// changes anything.
+func (p *PeerConn) SetInterested(interested bool) error {
+	if interested == p.amInterested {
+		return nil
+	}
+	id := MsgNotInterested
+	if interested {
+		id = MsgInterested
+	}
+	if err := p.Send(&Message{ID: id}); err != nil {
+		return err
+	}
+	p.amInterested = interested
+	return nil
+}
+
+// SetChoking chokes or unchokes the peer, if that changes anything.
+func (p *PeerConn) SetChoking(choking bool) error {
+	if choking == p.amChoking {
+		return nil
+	}
+	id := MsgUnchoke
+	if choking {
+		id = MsgChoke
+	}
+	if err := p.Send(&Message{ID: id}); err != nil {
+		return err
+	}
+	p.amChoking = choking
+	return nil
+}
+
+func (p *PeerConn) handle(msg *Message) error {
+	if msg == nil {
+		return nil
+	}
+	early := !p.knowsPieces
+	switch msg.ID {
+	case MsgHave, MsgBitfield, MsgPiece:
+		p.knowsPieces = true
+	}
+	switch msg.ID {
+	case MsgChoke:
+		p.peerChoking = true
+	case MsgUnchoke:
+		p.peerChoking = false
+	case MsgInterested:
+		p.peerInterested = true
+	case MsgNotInterested:
+		p.peerInterested = false
+	case MsgHave:
+		index, err := msg.ParseHave()
+		if err != nil {
+			return err
+		}
+		if index >= p.numPieces {
+			return fmt.Errorf("peer has piece %d of %d", index, p.numPieces)
+		}
+		p.bitfield.Set(index)
+	case MsgBitfield:
+		if !early {
+			return errors.New("bitfield sent after have or piece messages")
+		}
+		if len(msg.Payload) != len(p.bitfield) {
+			return fmt.Errorf("bitfield is %d bytes, want %d", len(msg.Payload), len(p.bitfield))
+		}
+		// spare bits at the end must be clear
+		if p.numPieces%8 != 0 && msg.Payload[len(msg.Payload)-1]&(0xff>>(p.numPieces%8)) != 0 {
+			return errors.New("bitfield has spare bits set")
+		}
+		copy(p.bitfield, msg.Payload)
+	}
+	return nil
+}
+
+// peerEvent is a message read by readLoop, or the error that ended it.
+type peerEvent struct {
+	msg *Message
+	err error
+}
+
+// readLoop reads messages into events until the connection fails, so the
+// caller can wait for messages and other events at the same time. It does
+// not touch the connection state; the caller passes each message to handle.
+func (p *PeerConn) readLoop(events chan<- peerEvent, stop <-chan struct{}) {
+	for {
+		p.conn.SetReadDeadline(time.Now().Add(peerReadTimeout))
+		msg, err := ReadMessage(p.conn)
+		if err == nil && msg == nil {
+			continue
+		}
+		select {
+		case events <- peerEvent{msg, err}:
+		case <-stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
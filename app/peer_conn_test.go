@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestPeerConnBitfieldOrder(t *testing.T) {
+	bitfield := NewBitfield([]byte{0xff, 0xc0})
+	tests := []struct {
+		name    string
+		msgs    []*Message
+		wantErr bool
+	}{
+		{"bitfield first", []*Message{bitfield}, false},
+		{"after extension handshake", []*Message{NewExtended(0, []byte("de")), bitfield}, false},
+		{"after unchoke and interested", []*Message{{ID: MsgUnchoke}, {ID: MsgInterested}, bitfield}, false},
+		{"after have", []*Message{NewHave(1), bitfield}, true},
+		{"twice", []*Message{bitfield, bitfield}, true},
+		{"after piece", []*Message{NewPiece(0, 0, []byte{1}), bitfield}, true},
+		{"wrong length", []*Message{NewBitfield([]byte{0xff})}, true},
+		{"spare bits set", []*Message{NewBitfield([]byte{0xff, 0xe0})}, true},
+	}
+	for _, tt := range tests {
+		p := newPeerConn(nil, 10)
+		var err error
+		for _, msg := range tt.msgs {
+			if err = p.handle(msg); err != nil {
+				break
+			}
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && !p.Has(9) {
+			t.Errorf("%s: bitfield not recorded", tt.name)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"math/bits"
+	"math/rand/v2"
+	"sync"
+)
+
+// randomFirstPieces is how many pieces are picked at random before
+// switching to rarest-first. A new download wants complete pieces quickly
+// so it has something to offer, and the rarest pieces tend to be slow.
+const randomFirstPieces = 4
+
+type pieceState uint8
+
+const (
+	pieceWanted pieceState = iota
+	pieceInProgress
+	pieceDone
+)
+
+// PiecePicker decides which piece to download next. It counts how many
+// connected peers have each piece and picks the rarest piece a peer has,
+// breaking ties at random. Once no piece is left unassigned it is in
+// endgame, and pieces in progress may be handed out again.
+type PiecePicker struct {
+	mu           sync.Mutex
+	availability []int
+	state        []pieceState
+	holders      []int // workers downloading each piece
+	completed    int
+}
+
+func NewPiecePicker(numPieces int) *PiecePicker {
+	return &PiecePicker{
+		availability: make([]int, numPieces),
+		state:        make([]pieceState, numPieces),
+		holders:      make([]int, numPieces),
+	}
+}
+
+// AddBitfield counts the pieces of a peer's bitfield.
+func (p *PiecePicker) AddBitfield(bitfield Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.availability {
+		if bitfield.Has(i) {
+			p.availability[i]++
+		}
+	}
+}
+
+// RemoveBitfield stops counting the pieces of a peer that disconnected.
+func (p *PiecePicker) RemoveBitfield(bitfield Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.availability {
+		if bitfield.Has(i) {
+			p.availability[i]--
+		}
+	}
+}
+
+// AddHave counts a piece a peer announced with a have message.
+func (p *PiecePicker) AddHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// Pick chooses a wanted piece that the peer has and marks it in progress.
+func (p *PiecePicker) Pick(has func(int) bool) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	random := p.completed < randomFirstPieces
+	best, ties := -1, 0
+	for i, state := range p.state {
+		if state != pieceWanted || !has(i) {
+			continue
+		}
+		switch {
+		case random, best >= 0 && p.availability[i] == p.availability[best]:
+			// reservoir sampling keeps every candidate equally likely
+			ties++
+			if rand.IntN(ties) == 0 {
+				best = i
+			}
+		case best < 0 || p.availability[i] < p.availability[best]:
+			best, ties = i, 1
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	p.state[best] = pieceInProgress
+	p.holders[best] = 1
+	return best, true
+}
+
+// PickEndgame chooses a piece in progress that the peer has and the
+// worker does not already hold, preferring pieces with the fewest holders.
+func (p *PiecePicker) PickEndgame(has, holds func(int) bool) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best, ties := -1, 0
+	for i, state := range p.state {
+		if state != pieceInProgress || !has(i) || holds(i) {
+			continue
+		}
+		switch {
+		case best < 0 || p.holders[i] < p.holders[best]:
+			best, ties = i, 1
+		case p.holders[i] == p.holders[best]:
+			ties++
+			if rand.IntN(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	p.holders[best]++
+	return best, true
+}
+
+// Abort releases a worker's hold on a piece. An unfinished piece nobody
+// holds becomes available to Pick again.
+func (p *PiecePicker) Abort(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.holders[index] > 0 {
+		p.holders[index]--
+	}
+	if p.holders[index] == 0 && p.state[index] == pieceInProgress {
+		p.state[index] = pieceWanted
+	}
+}
+
+// Endgame reports whether every unfinished piece is being downloaded.
+func (p *PiecePicker) Endgame() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.completed == len(p.state) {
+		return false
+	}
+	for _, state := range p.state {
+		if state == pieceWanted {
+			return false
+		}
+	}
+	return true
+}
+
+// Remaining returns the number of pieces not yet verified.
+func (p *PiecePicker) Remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.state) - p.completed
+}
+
+// Done records that a piece has been verified.
+func (p *PiecePicker) Done(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[index] != pieceDone {
+		p.state[index] = pieceDone
+		p.completed++
+	}
+}
+
+// peerInterest tracks whether a peer has a piece we lack. It is kept up to
+// date as either side gains pieces, so that checking it does not scan every
+// piece of a large torrent.
+type peerInterest struct {
+	ours   Bitfield
+	wanted int // pieces the peer has and we lack
+}
+
+func newPeerInterest(ours Bitfield) *peerInterest {
+	return &peerInterest{ours: append(Bitfield(nil), ours...)}
+}
+
+// peerBitfield counts the pieces of the peer's bitfield.
+func (in *peerInterest) peerBitfield(theirs Bitfield) {
+	in.wanted = 0
+	for i, b := range theirs {
+		if i < len(in.ours) {
+			in.wanted += bits.OnesCount8(b &^ in.ours[i])
+		}
+	}
+}
+
+// peerHas counts a piece the peer announced that it did not have before.
+func (in *peerInterest) peerHas(index int) {
+	if !in.ours.Has(index) {
+		in.wanted++
+	}
+}
+
+// weHave records a piece we finished; peerHas says whether the peer has it.
+func (in *peerInterest) weHave(index int, peerHas bool) {
+	if in.ours.Has(index) {
+		return
+	}
+	in.ours.Set(index)
+	if peerHas {
+		in.wanted--
+	}
+}
+
+func (in *peerInterest) interested() bool {
+	return in.wanted > 0
+}
@@ -0,0 +1,208 @@
+package main
+
+import "testing"
+
+func hasAll(int) bool { return true }
+
+// newTestPicker returns a picker past the random-first phase, with piece i
+// held by availability[i] peers.
+func newTestPicker(t *testing.T, availability ...int) *PiecePicker {
+	t.Helper()
+	p := NewPiecePicker(len(availability) + randomFirstPieces)
+	for i, n := range availability {
+		for range n {
+			p.AddHave(i)
+		}
+	}
+	for i := len(availability); i < len(availability)+randomFirstPieces; i++ {
+		p.Done(i)
+	}
+	return p
+}
+
+func TestPickRarestFirst(t *testing.T) {
+	p := newTestPicker(t, 3, 1, 4, 2, 5)
+	var got []int
+	for {
+		index, ok := p.Pick(hasAll)
+		if !ok {
+			break
+		}
+		got = append(got, index)
+	}
+	want := []int{1, 3, 0, 2, 4}
+	if len(got) != len(want) {
+		t.Fatalf("picked %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("picked %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPickOnlyPiecesThePeerHas(t *testing.T) {
+	p := newTestPicker(t, 1, 5, 2)
+	has := func(i int) bool { return i == 1 }
+	if index, ok := p.Pick(has); !ok || index != 1 {
+		t.Errorf("Pick = %d, %v, want 1", index, ok)
+	}
+	if index, ok := p.Pick(has); ok {
+		t.Errorf("Pick = %d after the peer's only piece was taken", index)
+	}
+}
+
+func TestPickBreaksTiesAtRandom(t *testing.T) {
+	seen := map[int]bool{}
+	for range 200 {
+		p := newTestPicker(t, 2, 1, 1, 1, 3)
+		index, _ := p.Pick(hasAll)
+		if index < 1 || index > 3 {
+			t.Fatalf("Pick = %d, want one of the rarest pieces 1 to 3", index)
+		}
+		seen[index] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("picked only %v of the tied pieces in 200 tries", seen)
+	}
+}
+
+// Until randomFirstPieces pieces are done, any wanted piece may be picked,
+// not just the rarest.
+func TestPickRandomFirst(t *testing.T) {
+	seen := map[int]bool{}
+	for range 200 {
+		p := NewPiecePicker(4)
+		p.AddHave(0)
+		for i := 1; i < 4; i++ {
+			p.AddHave(i)
+			p.AddHave(i)
+		}
+		index, _ := p.Pick(hasAll)
+		seen[index] = true
+	}
+	if len(seen) != 4 {
+		t.Errorf("picked only %v of 4 pieces in 200 tries", seen)
+	}
+
+	p := NewPiecePicker(randomFirstPieces + 2)
+	for i := range randomFirstPieces {
+		p.Done(i)
+	}
+	p.AddHave(randomFirstPieces)
+	if index, _ := p.Pick(hasAll); index != randomFirstPieces+1 {
+		t.Errorf("Pick after %d pieces = %d, want the rarest piece %d", randomFirstPieces, index, randomFirstPieces+1)
+	}
+}
+
+func TestRemoveBitfield(t *testing.T) {
+	p := newTestPicker(t, 0, 0)
+	a, b := newBitfield(2), newBitfield(2)
+	a.Set(0)
+	a.Set(1)
+	b.Set(1)
+	p.AddBitfield(a)
+	p.AddBitfield(b)
+	p.RemoveBitfield(b)
+	p.AddHave(0)
+	// piece 0 is now held by two peers and piece 1 by one
+	if index, _ := p.Pick(hasAll); index != 1 {
+		t.Errorf("Pick = %d, want 1", index)
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	p := newTestPicker(t, 1, 1)
+	if p.Endgame() {
+		t.Fatal("endgame before any piece was picked")
+	}
+	first, _ := p.Pick(hasAll)
+	second, _ := p.Pick(hasAll)
+	if !p.Endgame() {
+		t.Fatal("not in endgame with every piece in progress")
+	}
+	if index, ok := p.Pick(hasAll); ok {
+		t.Fatalf("Pick = %d in endgame", index)
+	}
+
+	// a second worker joins the piece with the fewest holders, and never
+	// one it already holds
+	holds := func(i int) bool { return i == first }
+	joined, ok := p.PickEndgame(hasAll, holds)
+	if !ok || joined != second {
+		t.Fatalf("PickEndgame = %d, %v, want %d", joined, ok, second)
+	}
+	if index, ok := p.PickEndgame(hasAll, func(i int) bool { return true }); ok {
+		t.Errorf("PickEndgame = %d for a worker holding every piece", index)
+	}
+	// now piece first has one holder and second has two
+	if index, _ := p.PickEndgame(hasAll, func(int) bool { return false }); index != first {
+		t.Errorf("PickEndgame = %d, want the piece with fewer holders %d", index, first)
+	}
+
+	// the piece stays in progress until its last holder lets go
+	p.Abort(second)
+	if !p.Endgame() {
+		t.Error("piece released while another worker still holds it")
+	}
+	p.Abort(second)
+	if p.Endgame() {
+		t.Error("piece with no holders is still in progress")
+	}
+	// a duplicate abort must not go below zero holders
+	p.Abort(second)
+	if index, ok := p.Pick(hasAll); !ok || index != second {
+		t.Fatalf("Pick = %d, %v, want the released piece %d", index, ok, second)
+	}
+	if index, ok := p.PickEndgame(hasAll, func(i int) bool { return i != second }); !ok || index != second {
+		t.Fatalf("PickEndgame = %d, %v, want %d", index, ok, second)
+	}
+
+	// once a piece is done, aborts from its other holders leave it done
+	p.Done(first)
+	p.Abort(first)
+	p.Abort(first)
+	if p.Remaining() != 1 {
+		t.Errorf("Remaining = %d, want 1", p.Remaining())
+	}
+	if index, ok := p.PickEndgame(hasAll, func(int) bool { return false }); !ok || index != second {
+		t.Errorf("PickEndgame = %d, %v, want %d", index, ok, second)
+	}
+	p.Done(second)
+	p.Done(second)
+	if p.Remaining() != 0 || p.Endgame() {
+		t.Errorf("Remaining = %d, Endgame = %v once every piece is done", p.Remaining(), p.Endgame())
+	}
+}
+
+func TestPeerInterest(t *testing.T) {
+	ours := newBitfield(10)
+	ours.Set(0)
+	in := newPeerInterest(ours)
+	if in.interested() {
+		t.Fatal("interested in a peer with no pieces")
+	}
+
+	theirs := newBitfield(10)
+	theirs.Set(0)
+	in.peerBitfield(theirs)
+	if in.interested() {
+		t.Error("interested in a peer with only a piece we have")
+	}
+	theirs.Set(9)
+	in.peerHas(9)
+	if !in.interested() {
+		t.Error("not interested in a peer with a piece we lack")
+	}
+	in.peerHas(0)
+	in.weHave(9, true)
+	if in.interested() {
+		t.Error("still interested after finishing the peer's only new piece")
+	}
+	in.weHave(9, true)
+	in.weHave(5, false)
+	in.peerHas(5)
+	if in.interested() || in.wanted != 0 {
+		t.Errorf("interested = %v with %d wanted pieces, want none", in.interested(), in.wanted)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// initialQueueDepth is the number of block requests kept outstanding
+	// before anything has been measured.
+	initialQueueDepth = 5
+	minQueueDepth     = 2
+	// maxQueueDepth caps the depth for peers that do not send reqq.
+	maxQueueDepth = 250
+	// requestQueueTime is how much data, in seconds of transfer at the
+	// measured rate, is kept requested from a peer.
+	requestQueueTime = 3 * time.Second
+	// rateWindow is how often throughput is sampled and the depth adjusted.
+	rateWindow = time.Second
+)
+
+// blockRequest is a request sent to a peer and not yet answered.
+type blockRequest struct {
+	index, begin, length int
+	sent                 time.Time
+}
+
+// requestPipeline keeps a peer's request queue filled. Its depth follows
+// the bandwidth-delay product: enough blocks for requestQueueTime at the
+// measured rate, backed off when round trips grow longer than that, and
+// never more than the peer's reqq.
+type requestPipeline struct {
+	depth       int
+	maxDepth    int
+	outstanding []blockRequest
+
+	rate        float64       // bytes per second, smoothed
+	rtt         time.Duration // request round trip, smoothed
+	windowBytes int
+	windowStart time.Time
+
+	now func() time.Time // time.Now, except in tests
+}
+
+func newRequestPipeline() *requestPipeline {
+	return &requestPipeline{
+		depth:       initialQueueDepth,
+		maxDepth:    maxQueueDepth,
+		windowStart: time.Now(),
+		now:         time.Now,
+	}
+}
+
+// setReqq limits the depth to the queue length the peer advertised in its
+// extension handshake.
+func (p *requestPipeline) setReqq(reqq int) {
+	if reqq <= 0 {
+		return
+	}
+	p.maxDepth = min(reqq, maxQueueDepth)
+	p.depth = min(p.depth, p.maxDepth)
+}
+
+// full reports whether no more requests should be sent for now.
+func (p *requestPipeline) full() bool {
+	return len(p.outstanding) >= p.depth
+}
+
+// send records a request as outstanding.
+func (p *requestPipeline) send(index, begin, length int) {
+	p.outstanding = append(p.outstanding, blockRequest{index, begin, length, p.now()})
+}
+
+// receive matches a block against the outstanding requests and updates
+// the measurements. It reports false for a block that was not requested.
+func (p *requestPipeline) receive(index, begin, length int) bool {
+	for _, req := range p.outstanding {
+		if req.index != index || req.begin != begin || req.length != length {
+			continue
+		}
+		p.cancel(index, begin, length)
+		now := p.now()
+		sample := now.Sub(req.sent)
+		if p.rtt == 0 {
+			p.rtt = sample
+		} else {
+			p.rtt = (7*p.rtt + sample) / 8
+		}
+		p.windowBytes += length
+		if elapsed := now.Sub(p.windowStart); elapsed >= rateWindow {
+			sampleRate := float64(p.windowBytes) / elapsed.Seconds()
+			if p.rate == 0 {
+				p.rate = sampleRate
+			} else {
+				p.rate = 0.7*p.rate + 0.3*sampleRate
+			}
+			p.windowBytes, p.windowStart = 0, now
+			p.adjust()
+		}
+		return true
+	}
+	return false
+}
+
+func (p *requestPipeline) adjust() {
+	depth := p.rate * requestQueueTime.Seconds() / BlockSize
+	if p.rtt > requestQueueTime {
+		depth = depth * float64(requestQueueTime) / float64(p.rtt)
+	}
+	p.depth = max(minQueueDepth, min(p.maxDepth, int(depth)+1))
+}
+
+// cancel forgets an outstanding request and reports whether there was one.
+func (p *requestPipeline) cancel(index, begin, length int) bool {
+	for i, req := range p.outstanding {
+		if req.index == index && req.begin == begin && req.length == length {
+			p.outstanding = append(p.outstanding[:i], p.outstanding[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// remove forgets the outstanding requests of a piece.
+func (p *requestPipeline) remove(index int) {
+	kept := p.outstanding[:0]
+	for _, req := range p.outstanding {
+		if req.index != index {
+			kept = append(kept, req)
+		}
+	}
+	p.outstanding = kept
+}
+
+// reset forgets every outstanding request, which a choke cancels.
+func (p *requestPipeline) reset() {
+	p.outstanding = p.outstanding[:0]
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// window is a second of transfer: blocks requests, each answered after rtt.
+type window struct {
+	blocks int
+	rtt    time.Duration
+}
+
+// feed runs the windows through p, spreading each window's blocks evenly
+// so that the last one arrives as the window closes.
+func feed(p *requestPipeline, windows []window) {
+	start := time.Unix(1000, 0)
+	var clock time.Time
+	p.now = func() time.Time { return clock }
+	p.windowStart = start
+	for i, w := range windows {
+		windowStart := start.Add(time.Duration(i) * rateWindow)
+		for k := 1; k <= w.blocks; k++ {
+			arrival := windowStart.Add(rateWindow * time.Duration(k) / time.Duration(w.blocks))
+			clock = arrival.Add(-w.rtt)
+			p.send(0, k*BlockSize, BlockSize)
+			clock = arrival
+			p.receive(0, k*BlockSize, BlockSize)
+		}
+	}
+}
+
+func repeat(n int, w window) []window {
+	windows := make([]window, n)
+	for i := range windows {
+		windows[i] = w
+	}
+	return windows
+}
+
+func TestRequestPipelineDepth(t *testing.T) {
+	fast := window{100, 100 * time.Millisecond}
+	tests := []struct {
+		name      string
+		reqq      int // sent before any data
+		windows   []window
+		reqqAfter int // sent after the windows
+		want      int
+	}{
+		{"initial", 0, nil, 0, initialQueueDepth},
+		{"grows with the rate", 0, repeat(3, window{10, 100 * time.Millisecond}), 0, 31},
+		{"slow peer", 0, repeat(3, window{1, 100 * time.Millisecond}), 0, 4},
+		{"capped without reqq", 0, repeat(3, fast), 0, maxQueueDepth},
+		{"capped by reqq", 50, repeat(3, fast), 0, 50},
+		{"reqq lowers a grown depth", 0, repeat(3, fast), 20, 20},
+		{"reqq above the cap", 1000, repeat(3, fast), 0, maxQueueDepth},
+		{"backs off on long round trips", 0, repeat(3, window{20, 6 * time.Second}), 0, 31},
+		{"never below the minimum", 0, repeat(3, window{1, 10 * time.Second}), 0, minQueueDepth},
+		{"shrinks when the rate drops", 0, append(repeat(3, fast), repeat(10, window{2, 100 * time.Millisecond})...), 0, 15},
+	}
+	for _, tt := range tests {
+		p := newRequestPipeline()
+		p.setReqq(tt.reqq)
+		feed(p, tt.windows)
+		p.setReqq(tt.reqqAfter)
+		if p.depth != tt.want {
+			t.Errorf("%s: depth = %d, want %d", tt.name, p.depth, tt.want)
+		}
+	}
+}
+
+func TestRequestPipelineRequests(t *testing.T) {
+	p := newRequestPipeline()
+	for i := range initialQueueDepth {
+		if p.full() {
+			t.Fatalf("full after %d requests", i)
+		}
+		p.send(i%2, i*BlockSize, BlockSize)
+	}
+	if !p.full() {
+		t.Fatal("not full at the initial depth")
+	}
+	if p.receive(9, 0, BlockSize) {
+		t.Error("received a block that was never requested")
+	}
+	if !p.cancel(0, 0, BlockSize) {
+		t.Error("cancel of an outstanding request failed")
+	}
+	if p.cancel(0, 0, BlockSize) {
+		t.Error("duplicate cancel succeeded")
+	}
+	if p.receive(0, 0, BlockSize) {
+		t.Error("received a cancelled block")
+	}
+	p.remove(1)
+	if len(p.outstanding) != 2 {
+		t.Errorf("%d requests outstanding after removing piece 1, want 2", len(p.outstanding))
+	}
+	p.reset()
+	if len(p.outstanding) != 0 {
+		t.Errorf("%d requests outstanding after reset", len(p.outstanding))
+	}
+}
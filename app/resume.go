@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
+)
+
+// resumeData is the fast-resume sidecar kept next to a download: the
+// pieces verified so far and the state of the files when they were.
+type resumeData struct {
+	InfoHash [20]byte     `bencode:"info hash"`
+	Pieces   Bitfield     `bencode:"pieces"`
+	Files    []resumeFile `bencode:"files"`
+}
+
+type resumeFile struct {
+	Size  int64 `bencode:"size"`
+	Mtime int64 `bencode:"mtime"` // unix nanoseconds
+}
+
+// resumePath is where the sidecar of a download to outputPath lives: next
+// to the file of a single-file torrent, or to the torrent's directory.
+func resumePath(outputPath string, info *Info) string {
+	if info.IsMultiFile() {
+		return filepath.Join(outputPath, info.Name) + ".resume"
+	}
+	return outputPath + ".resume"
+}
+
+// statFiles records the size and mtime of the torrent's files. Missing
+// files count as empty.
+func statFiles(layout *fileLayout) ([]resumeFile, error) {
+	files := make([]resumeFile, len(layout.files))
+	for i, lf := range layout.files {
+		fi, err := os.Stat(lf.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[i] = resumeFile{Size: fi.Size(), Mtime: fi.ModTime().UnixNano()}
+	}
+	return files, nil
+}
+
+// loadResume returns the pieces a download to outputPath already has. The
+// sidecar is trusted for files that still have the size and mtime it
+// recorded; pieces overlapping any other file are hashed again, and without
+// a usable sidecar whatever data exists is. It must run before the storage
+// creates the files.
+func loadResume(outputPath string, infoHash [20]byte, info *Info) (Bitfield, error) {
+	layout := newFileLayout(outputPath, info)
+	layout.readOnly = true
+	defer layout.Close()
+	files, err := statFiles(layout)
+	if err != nil {
+		return nil, err
+	}
+
+	var resume resumeData
+	if data, err := os.ReadFile(resumePath(outputPath, info)); err == nil &&
+		bencode.Unmarshal(data, &resume) == nil &&
+		resume.InfoHash == infoHash &&
+		len(resume.Pieces) == len(newBitfield(info.NumPieces())) &&
+		len(resume.Files) == len(files) {
+		have := resume.Pieces
+		stale := newBitfield(info.NumPieces())
+		for i, lf := range layout.files {
+			if files[i] == resume.Files[i] || lf.length == 0 {
+				continue
+			}
+			first := int(lf.offset / info.PieceLength)
+			last := int((lf.offset + lf.length - 1) / info.PieceLength)
+			for piece := first; piece <= last; piece++ {
+				stale.Set(piece)
+			}
+		}
+		var indexes []int
+		for i := range info.NumPieces() {
+			if stale.Has(i) {
+				indexes = append(indexes, i)
+			}
+		}
+		recheckPieces(info, layout, have, indexes)
+		return have, nil
+	}
+
+	for _, f := range files {
+		if f.Size > 0 {
+			return verifyPieces(info, layout), nil
+		}
+	}
+	return newBitfield(info.NumPieces()), nil
+}
+
+// saveResume writes the sidecar for the pieces in have. The storage must be
+// closed first, so that the recorded mtimes are final.
+func saveResume(outputPath string, infoHash [20]byte, info *Info, have Bitfield) error {
+	files, err := statFiles(newFileLayout(outputPath, info))
+	if err != nil {
+		return err
+	}
+	data, err := bencode.Marshal(resumeData{InfoHash: infoHash, Pieces: have, Files: files})
+	if err != nil {
+		return err
+	}
+	path := resumePath(outputPath, info)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
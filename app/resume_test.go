@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+var resumeMtime = time.Unix(1700000000, 0)
+
+// writeResumeTorrent downloads a torrent of two 8-byte files, two pieces
+// each, into a new directory: the files with mtime resumeMtime and a
+// sidecar claiming every piece.
+func writeResumeTorrent(t *testing.T) (dir string, info *Info, infoHash [20]byte) {
+	t.Helper()
+	dir = t.TempDir()
+	info = multiFileInfo(4, 8, 8)
+	data := []byte("0000111122223333")
+	for i := range info.Pieces {
+		info.Pieces[i] = sha1.Sum(data[i*4 : i*4+4])
+	}
+	infoHash = [20]byte{7}
+
+	layout := newFileLayout(dir, info)
+	if err := layout.create(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := layout.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := layout.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, lf := range layout.files {
+		if err := os.Chtimes(lf.path, resumeMtime, resumeMtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	have := newBitfield(info.NumPieces())
+	for i := range info.NumPieces() {
+		have.Set(i)
+	}
+	if err := saveResume(dir, infoHash, info, have); err != nil {
+		t.Fatal(err)
+	}
+	return dir, info, infoHash
+}
+
+// overwrite replaces the start of file i of the torrent and sets its mtime.
+func overwrite(t *testing.T, dir string, info *Info, i int, data string, mtime time.Time) {
+	t.Helper()
+	path := filepath.Join(dir, info.Name, info.Files[i].Path[0])
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pieceList(have Bitfield, numPieces int) []int {
+	pieces := []int{}
+	for i := range numPieces {
+		if have.Has(i) {
+			pieces = append(pieces, i)
+		}
+	}
+	return pieces
+}
+
+func TestLoadResume(t *testing.T) {
+	later := resumeMtime.Add(time.Second)
+	tests := []struct {
+		name   string
+		change func(t *testing.T, dir string, info *Info)
+		want   []int
+	}{
+		{
+			// the sidecar is believed even though piece 0 is now corrupt,
+			// which shows nothing was hashed
+			"size and mtime match",
+			func(t *testing.T, dir string, info *Info) {
+				overwrite(t, dir, info, 0, "x", resumeMtime)
+			},
+			[]int{0, 1, 2, 3},
+		},
+		{
+			// only the pieces of the second file are hashed again
+			"mtime differs",
+			func(t *testing.T, dir string, info *Info) {
+				overwrite(t, dir, info, 0, "x", resumeMtime)
+				overwrite(t, dir, info, 1, "x", later)
+			},
+			[]int{0, 1, 3},
+		},
+		{
+			"size differs",
+			func(t *testing.T, dir string, info *Info) {
+				path := filepath.Join(dir, info.Name, info.Files[1].Path[0])
+				if err := os.Truncate(path, 6); err != nil {
+					t.Fatal(err)
+				}
+				os.Chtimes(path, resumeMtime, resumeMtime)
+			},
+			[]int{0, 1, 2},
+		},
+		{
+			"corrupt sidecar",
+			func(t *testing.T, dir string, info *Info) {
+				overwrite(t, dir, info, 0, "x", resumeMtime)
+				if err := os.WriteFile(resumePath(dir, info), []byte("d5:pieces"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			[]int{1, 2, 3},
+		},
+		{
+			"no sidecar",
+			func(t *testing.T, dir string, info *Info) {
+				overwrite(t, dir, info, 1, "x", resumeMtime)
+				if err := os.Remove(resumePath(dir, info)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			[]int{0, 1, 3},
+		},
+		{
+			"no data",
+			func(t *testing.T, dir string, info *Info) {
+				if err := os.RemoveAll(filepath.Join(dir, info.Name)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			[]int{},
+		},
+	}
+	for _, tt := range tests {
+		dir, info, infoHash := writeResumeTorrent(t)
+		tt.change(t, dir, info)
+		have, err := loadResume(dir, infoHash, info)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := pieceList(have, info.NumPieces()); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: pieces = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A sidecar written for another torrent is ignored.
+func TestLoadResumeOtherTorrent(t *testing.T) {
+	dir, info, _ := writeResumeTorrent(t)
+	overwrite(t, dir, info, 0, "x", resumeMtime)
+	have, err := loadResume(dir, [20]byte{8}, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pieceList(have, info.NumPieces()); !slices.Equal(got, []int{1, 2, 3}) {
+		t.Errorf("pieces = %v, want [1 2 3]", got)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxBlockRequest is the largest block we serve. Peers request 16 KiB
+// blocks; anything much larger is refused.
+const maxBlockRequest = 128 * 1024
+
+// seedTorrent is a torrent we upload: the data we have and which pieces
+// of it are verified.
+type seedTorrent struct {
+	infoHash [20]byte
+	info     *Info
+	data     io.ReaderAt
+
+	uploaded atomic.Int64
+
+	choker *choker
+
+	mu       sync.Mutex
+	have     Bitfield
+	sessions map[*uploadSession]bool
+}
+
+// newSeedTorrent serves the pieces in have from data, which is read at
+// torrent offsets.
+func newSeedTorrent(infoHash [20]byte, info *Info, data io.ReaderAt, have Bitfield) *seedTorrent {
+	if have == nil {
+		have = newBitfield(info.NumPieces())
+	}
+	t := &seedTorrent{
+		infoHash: infoHash,
+		info:     info,
+		data:     data,
+		have:     have,
+		sessions: map[*uploadSession]bool{},
+	}
+	t.choker = newChoker(t.complete)
+	return t
+}
+
+// Stats reports transfer totals for tracker announces.
+func (t *seedTorrent) Stats() (uploaded, downloaded, left int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := 0; i < t.info.NumPieces(); i++ {
+		if !t.have.Has(i) {
+			left += int64(t.info.PieceSize(i))
+		}
+	}
+	return t.uploaded.Load(), 0, left
+}
+
+// Done never fires: a seed has nothing to complete.
+func (t *seedTorrent) Done() <-chan struct{} {
+	return nil
+}
+
+// markHave makes a newly verified piece available and announces it to
+// every connected peer.
+func (t *seedTorrent) markHave(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.have.Has(index) {
+		return
+	}
+	t.have.Set(index)
+	for s := range t.sessions {
+		s.haves <- index
+	}
+}
+
+// complete reports whether we have every piece, in which case we seed.
+func (t *seedTorrent) complete() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := 0; i < t.info.NumPieces(); i++ {
+		if !t.have.Has(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// bitfield returns a copy of the pieces we have.
+func (t *seedTorrent) bitfield() Bitfield {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append(Bitfield(nil), t.have...)
+}
+
+func (t *seedTorrent) hasPiece(index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.have.Has(index)
+}
+
+// uploadSession serves our pieces over one peer connection, whether we
+// opened it to download or the peer connected to us.
+type uploadSession struct {
+	t      *seedTorrent
+	pc     *PeerConn
+	peer   *chokerPeer
+	haves  chan int // pieces completed since the session started
+	joined Bitfield // pieces we had when it started
+}
+
+// join starts uploading over pc. It sends our bitfield, which has to be the
+// first message on the connection, and registers the peer with the choker.
+// The haves channel has room for every piece, so markHave never blocks.
+func (t *seedTorrent) join(pc *PeerConn) (*uploadSession, error) {
+	s := &uploadSession{
+		t:     t,
+		pc:    pc,
+		peer:  t.choker.add(),
+		haves: make(chan int, t.info.NumPieces()),
+	}
+	t.mu.Lock()
+	t.sessions[s] = true
+	bitfield := append(Bitfield(nil), t.have...)
+	t.mu.Unlock()
+	s.joined = bitfield
+	for _, b := range bitfield {
+		if b != 0 {
+			if err := pc.Send(NewBitfield(bitfield)); err != nil {
+				s.leave()
+				return nil, err
+			}
+			break
+		}
+	}
+	return s, nil
+}
+
+func (s *uploadSession) leave() {
+	s.t.mu.Lock()
+	delete(s.t.sessions, s)
+	s.t.mu.Unlock()
+	s.t.choker.remove(s.peer)
+}
+
+// handle answers the peer's interest and requests. The message must
+// already have been applied to the connection state.
+func (s *uploadSession) handle(msg *Message) error {
+	switch msg.ID {
+	case MsgInterested, MsgNotInterested:
+		s.peer.peerInterested.Store(s.pc.PeerInterested())
+		s.t.choker.interestChanged()
+	case MsgRequest:
+		if s.pc.AmChoking() {
+			return nil // requests made while choked are dropped
+		}
+		index, begin, length, err := msg.ParseRequest()
+		if err != nil {
+			return err
+		}
+		return s.upload(index, begin, length)
+	}
+	return nil
+}
+
+// upload answers a request from verified data.
+func (s *uploadSession) upload(index, begin, length int) error {
+	t := s.t
+	if index < 0 || index >= t.info.NumPieces() || !t.hasPiece(index) {
+		return fmt.Errorf("request for piece %d, which we do not have", index)
+	}
+	if begin < 0 || length <= 0 || length > maxBlockRequest || begin+length > t.info.PieceSize(index) {
+		return fmt.Errorf("invalid request for %d bytes at %d of piece %d", length, begin, index)
+	}
+	block := make([]byte, length)
+	if _, err := t.data.ReadAt(block, int64(index)*t.info.PieceLength+int64(begin)); err != nil {
+		return err
+	}
+	if err := s.pc.Send(NewPiece(index, begin, block)); err != nil {
+		return err
+	}
+	t.uploaded.Add(int64(length))
+	s.peer.uploaded.Add(int64(length))
+	return nil
+}
+
+// serve uploads to a peer that connected to us, once the handshakes have
+// been exchanged.
+func (t *seedTorrent) serve(ctx context.Context, conn net.Conn) error {
+	pc := newPeerConn(conn, t.info.NumPieces())
+	s, err := t.join(pc)
+	if err != nil {
+		return err
+	}
+	defer s.leave()
+
+	events := make(chan peerEvent)
+	stopReading := make(chan struct{})
+	defer close(stopReading)
+	go pc.readLoop(events, stopReading)
+
+	for {
+		var ev peerEvent
+		select {
+		case ev = <-events:
+		case index := <-s.haves:
+			if err := pc.Send(NewHave(index)); err != nil {
+				return err
+			}
+			continue
+		case choking := <-s.peer.choke:
+			if err := pc.SetChoking(choking); err != nil {
+				return err
+			}
+			continue
+		case <-ctx.Done():
+			return nil
+		}
+		if ev.err != nil {
+			return ev.err
+		}
+		if err := pc.handle(ev.msg); err != nil {
+			return err
+		}
+		if err := s.handle(ev.msg); err != nil {
+			return err
+		}
+	}
+}
+
+// peerListener accepts inbound peer connections and hands each to the
+// torrent named by its handshake.
+type peerListener struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*seedTorrent
+}
+
+// listenForPeers listens on the port set by BITTORRENT_PORT, where 0 picks
+// any free port, or else on the first free port from defaultListenPort on.
+func listenForPeers() (*peerListener, error) {
+	var ports []int
+	if s := os.Getenv("BITTORRENT_PORT"); s != "" {
+		port, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BITTORRENT_PORT %q", s)
+		}
+		ports = append(ports, int(port))
+	} else {
+		for port := defaultListenPort; port <= defaultListenPort+listenPortFallbacks; port++ {
+			ports = append(ports, port)
+		}
+		ports = append(ports, 0)
+	}
+	var err error
+	for _, port := range ports {
+		var ln net.Listener
+		if ln, err = net.Listen("tcp", fmt.Sprintf(":%d", port)); err == nil {
+			return &peerListener{ln: ln, torrents: map[[20]byte]*seedTorrent{}}, nil
+		}
+	}
+	return nil, err
+}
+
+// sharedListener opens the process's peer listener on first use, by the
+// commands that serve peers.
+var sharedListener = sync.OnceValues(listenForPeers)
+
+// Port returns the port the listener is bound to.
+func (l *peerListener) Port() uint16 {
+	return uint16(l.ln.Addr().(*net.TCPAddr).Port)
+}
+
+// add makes a torrent reachable through the listener.
+func (l *peerListener) add(t *seedTorrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.torrents[t.infoHash] = t
+}
+
+func (l *peerListener) lookup(infoHash [20]byte) *seedTorrent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.torrents[infoHash]
+}
+
+// serve accepts connections until ctx is done.
+func (l *peerListener) serve(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() { l.ln.Close() })
+	defer stop()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stop()
+			err := l.handle(ctx, conn)
+			// peers hanging up is no news
+			if err != nil && ctx.Err() == nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("Inbound peer %s: %v\n", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// handle routes an inbound connection by the info hash in its handshake.
+func (l *peerListener) handle(ctx context.Context, conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	h, err := ReadHandshake(conn)
+	if err != nil {
+		return err
+	}
+	t := l.lookup(h.InfoHash)
+	if t == nil {
+		return fmt.Errorf("unknown info hash %x", h.InfoHash)
+	}
+	if h.PeerID == localPeerID {
+		return ErrSelfConnection
+	}
+	if _, err := newHandshake(t.infoHash, Capabilities{}).WriteTo(conn); err != nil {
+		return err
+	}
+	return t.serve(ctx, conn)
+}
+
+// start serves in the background. The returned function stops accepting
+// peers and waits until every inbound session has ended.
+func (l *peerListener) start(ctx context.Context) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := l.serve(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, "Error accepting peers:", err)
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
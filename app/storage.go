@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Storage holds a torrent's data, addressed by offset within the torrent's
+// contiguous byte stream. Pieces are written as they are verified, so
+// ReadAt and WriteAt may be called concurrently for different pieces.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	// MarkComplete is called once a piece has been written and verified.
+	MarkComplete(index int) error
+	Close() error
+}
+
+// openStorage opens the storage kind named on the command line for a
+// download to outputPath: "file" (the default), "mmap" or "memory".
+func openStorage(kind, outputPath string, info *Info) (Storage, error) {
+	var storage Storage
+	var err error
+	switch kind {
+	case "", "file":
+		storage, err = newFileStorage(outputPath, info)
+	case "mmap":
+		storage, err = newMmapStorage(outputPath, info)
+	case "memory":
+		storage = newMemoryStorage(info)
+	default:
+		err = fmt.Errorf("unknown storage %q", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+// fileStorage writes pieces straight into the torrent's files.
+type fileStorage struct {
+	*fileLayout
+}
+
+// newFileStorage creates the torrent's files under outputPath at their
+// full size. Existing data is kept.
+func newFileStorage(outputPath string, info *Info) (*fileStorage, error) {
+	layout := newFileLayout(outputPath, info)
+	if err := layout.create(); err != nil {
+		layout.Close()
+		return nil, err
+	}
+	return &fileStorage{fileLayout: layout}, nil
+}
+
+// MarkComplete does nothing. The resume sidecar is only written after
+// Close, which syncs the files, so syncing each piece would not save it
+// from being hashed again after a crash.
+func (s *fileStorage) MarkComplete(index int) error { return nil }
+
+// memoryStorage keeps the whole torrent in memory. It suits small
+// torrents and tests; saveDownload writes it out once it is complete.
+type memoryStorage struct {
+	data []byte
+}
+
+func newMemoryStorage(info *Info) *memoryStorage {
+	return &memoryStorage{data: make([]byte, info.TotalLength())}
+}
+
+func (s *memoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(s.data)) {
+		return 0, fmt.Errorf("read of %d bytes at %d outside torrent of %d bytes", len(p), off, len(s.data))
+	}
+	return copy(p, s.data[off:]), nil
+}
+
+func (s *memoryStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(s.data)) {
+		return 0, fmt.Errorf("write of %d bytes at %d outside torrent of %d bytes", len(p), off, len(s.data))
+	}
+	return copy(s.data[off:], p), nil
+}
+
+func (s *memoryStorage) MarkComplete(index int) error { return nil }
+func (s *memoryStorage) Close() error                 { return nil }
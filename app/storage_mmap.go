@@ -0,0 +1,100 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// mmapStorage maps the torrent's files into memory and copies blocks in
+// and out of the mappings, leaving write-back to the kernel.
+type mmapStorage struct {
+	*fileLayout
+
+	mu   sync.RWMutex // held for writing to unmap
+	maps [][]byte     // one per file, nil for empty files; nil once closed
+}
+
+func newMmapStorage(outputPath string, info *Info) (*mmapStorage, error) {
+	layout := newFileLayout(outputPath, info)
+	if err := layout.create(); err != nil {
+		layout.Close()
+		return nil, err
+	}
+	s := &mmapStorage{fileLayout: layout, maps: make([][]byte, len(layout.files))}
+	for i, lf := range layout.files {
+		if lf.length == 0 {
+			continue
+		}
+		f, err := layout.file(i)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		data, err := syscall.Mmap(int(f.Fd()), 0, int(lf.length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("mmap %s: %w", lf.path, err)
+		}
+		s.maps[i] = data
+	}
+	return s, nil
+}
+
+func (s *mmapStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.total {
+		return 0, fmt.Errorf("read of %d bytes at %d outside torrent of %d bytes", len(p), off, s.total)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.maps == nil {
+		return 0, os.ErrClosed
+	}
+	for _, span := range s.spans(off, int64(len(p))) {
+		copy(p[span.Offset:span.Offset+span.Length], s.maps[span.FileIndex][span.FileOffset:])
+	}
+	return len(p), nil
+}
+
+func (s *mmapStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.total {
+		return 0, fmt.Errorf("write of %d bytes at %d outside torrent of %d bytes", len(p), off, s.total)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.maps == nil {
+		return 0, os.ErrClosed
+	}
+	for _, span := range s.spans(off, int64(len(p))) {
+		copy(s.maps[span.FileIndex][span.FileOffset:], p[span.Offset:span.Offset+span.Length])
+	}
+	return len(p), nil
+}
+
+// MarkComplete does nothing; see fileStorage.MarkComplete.
+func (s *mmapStorage) MarkComplete(index int) error { return nil }
+
+// Close unmaps the files once no read or write is in progress; later ones
+// fail with os.ErrClosed. Closing the layout then syncs the files, which
+// writes back what was written through the mappings too.
+func (s *mmapStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for _, data := range s.maps {
+		if data == nil {
+			continue
+		}
+		if err := syscall.Munmap(data); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.maps = nil
+	if err := s.fileLayout.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import "errors"
+
+func newMmapStorage(outputPath string, info *Info) (Storage, error) {
+	return nil, errors.New("mmap storage is not supported on this platform")
+}
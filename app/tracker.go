@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// AnnounceEvent tells the tracker why an announce is sent. The values
+// match the BEP 15 encoding.
+type AnnounceEvent int32
+
+const (
+	EventNone AnnounceEvent = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+func (e AnnounceEvent) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	}
+	return ""
+}
+
+// defaultListenPort is where we listen for peers unless BITTORRENT_PORT
+// says otherwise. If it is taken, the next listenPortFallbacks ports are
+// tried, then any free port.
+const (
+	defaultListenPort   = 6881
+	listenPortFallbacks = 8
+)
+
+// lookupPort is announced by commands that only look up peers. They accept
+// no connections, so they open no listener and the port is nominal.
+const lookupPort = defaultListenPort
+
+// unknownLeft is announced as the amount left to download before a magnet
+// link's metadata is known. It must not be zero, or trackers would take us
+// for a seeder and leave other seeders out of the peer list.
+const unknownLeft = math.MaxInt32
+
+// sessionKey lets trackers recognise us across IP address changes.
+var sessionKey = rand.Uint32()
+
+// Tracker is a client for one announce URL.
+type Tracker interface {
+	Announce(ctx context.Context, req AnnounceRequest) (AnnounceResponse, error)
+	Scrape(ctx context.Context, infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error)
+}
+
+// ScrapeResult holds the swarm statistics a tracker reports for one torrent.
+type ScrapeResult struct {
+	Complete   int // seeders
+	Downloaded int // completed downloads
+	Incomplete int // leechers
+}
+
+// ErrScrapeUnsupported is returned when a tracker's announce URL has no
+// scrape counterpart.
+var ErrScrapeUnsupported = errors.New("tracker does not support scrape")
+
+// A TrackerError is a failure reported by the tracker itself, as opposed to
+// a network or protocol error.
+type TrackerError struct {
+	Reason string
+}
+
+func (e *TrackerError) Error() string {
+	return "tracker failure: " + e.Reason
+}
+
+var (
+	trackersMu sync.Mutex
+	trackers   = map[string]Tracker{}
+)
+
+// getTracker returns the shared client for trackerURL, so state such as
+// UDP connection IDs and HTTP tracker ids carries over between announces.
+func getTracker(trackerURL string) (Tracker, error) {
+	trackersMu.Lock()
+	defer trackersMu.Unlock()
+	if t, ok := trackers[trackerURL]; ok {
+		return t, nil
+	}
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, err
+	}
+	var t Tracker
+	switch u.Scheme {
+	case "http", "https":
+		t = newHTTPTracker(trackerURL)
+	case "udp":
+		if t, err = newUDPTracker(trackerURL); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+	trackers[trackerURL] = t
+	return t, nil
+}
+
+// getPeers announces the start of a download to a single tracker and
+// returns the peers it lists, giving port as the one we accept peers on.
+func getPeers(trackerURL string, infoHash [20]byte, left int64, port uint16) ([]Peer, error) {
+	tracker, err := getTracker(trackerURL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), announceTimeout)
+	defer cancel()
+
+	req := AnnounceRequest{
+		InfoHash: infoHash,
+		Port:     port,
+		Left:     left,
+		Event:    EventStarted,
+		Key:      sessionKey,
+		PeerID:   localPeerID,
+	}
+	res, err := tracker.Announce(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if res.Warning != "" {
+		fmt.Fprintf(os.Stderr, "Tracker warning from %s: %s\n", trackerURL, res.Warning)
+	}
+	return res.Peers, nil
+}
+
+// AnnounceRequest holds the parameters of an announce.
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	IP         net.IP // optional; the tracker uses the source address otherwise
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      AnnounceEvent
+	NumWant    int // zero lets the tracker decide
+	Key        uint32
+}
+
+func (r AnnounceRequest) numWant() int32 {
+	if r.NumWant <= 0 {
+		return -1
+	}
+	return int32(r.NumWant)
+}
+
+// AnnounceResponse is a tracker's answer to an announce.
+type AnnounceResponse struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	TrackerID   string
+	Warning     string
+	Complete    int // seeders
+	Incomplete  int // leechers
+	Peers       []Peer
+}
+
+// trackerTiers holds a torrent's announce URLs grouped into BEP 12 tiers.
+// Trackers are shuffled within each tier once, and a tracker that responds
+// is moved to the front of its tier so it is tried first next time.
+type trackerTiers struct {
+	mu    sync.Mutex
+	tiers [][]string
+}
+
+func newTrackerTiers(announce string, announceList [][]string) *trackerTiers {
+	t := &trackerTiers{}
+	for _, tier := range announceList {
+		var urls []string
+		for _, u := range tier {
+			if u != "" {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) == 0 {
+			continue
+		}
+		rand.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+		t.tiers = append(t.tiers, urls)
+	}
+	// announce is only used when there is no announce-list
+	if len(t.tiers) == 0 && announce != "" {
+		t.tiers = [][]string{{announce}}
+	}
+	return t
+}
+
+// Trackers returns the tiers for a torrent.
+func (m *Metainfo) Trackers() *trackerTiers {
+	return newTrackerTiers(m.Announce, m.AnnounceList)
+}
+
+// urls returns every tracker in tier order.
+func (t *trackerTiers) urls() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var urls []string
+	for _, tier := range t.tiers {
+		urls = append(urls, tier...)
+	}
+	return urls
+}
+
+// announce calls fn for each tracker in tier order until one succeeds and
+// returns its peers.
+func (t *trackerTiers) announce(fn func(trackerURL string) ([]Peer, error)) ([]Peer, error) {
+	var peers []Peer
+	err := t.try(func(trackerURL string) error {
+		var err error
+		peers, err = fn(trackerURL)
+		return err
+	})
+	return peers, err
+}
+
+// try calls fn for each tracker in tier order until one succeeds, and
+// promotes that tracker within its tier. The error lists every tracker
+// that failed.
+func (t *trackerTiers) try(fn func(trackerURL string) error) error {
+	t.mu.Lock()
+	tiers := make([][]string, len(t.tiers))
+	for i, tier := range t.tiers {
+		tiers[i] = append([]string(nil), tier...)
+	}
+	t.mu.Unlock()
+
+	if len(tiers) == 0 {
+		return errors.New("torrent has no trackers")
+	}
+	var errs []error
+	for i, tier := range tiers {
+		for _, trackerURL := range tier {
+			if err := fn(trackerURL); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", trackerURL, err))
+				continue
+			}
+			t.promote(i, trackerURL)
+			return nil
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// promote moves trackerURL to the front of tier i.
+func (t *trackerTiers) promote(i int, trackerURL string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tier := t.tiers[i]
+	for j, u := range tier {
+		if u == trackerURL {
+			copy(tier[1:j+1], tier[:j])
+			tier[0] = trackerURL
+			return
+		}
+	}
+}
+
+// getPeersFromTrackers asks all trackers at once and merges the peers they
+// return. It only fails if every tracker does.
+func getPeersFromTrackers(trackers []string, fn func(trackerURL string) ([]Peer, error)) ([]Peer, error) {
+	if len(trackers) == 0 {
+		return nil, errors.New("no trackers")
+	}
+	type result struct {
+		peers []Peer
+		err   error
+	}
+	results := make([]result, len(trackers))
+	var wg sync.WaitGroup
+	for i, trackerURL := range trackers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			peers, err := fn(trackerURL)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", trackerURL, err)
+			}
+			results[i] = result{peers, err}
+		}()
+	}
+	wg.Wait()
+
+	var peerList []Peer
+	var errs []error
+	seen := map[netip.AddrPort]bool{}
+	succeeded := false
+	for _, r := range results {
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		succeeded = true
+		for _, peer := range r.peers {
+			if !seen[peer.Addr] {
+				seen[peer.Addr] = true
+				peerList = append(peerList, peer)
+			}
+		}
+	}
+	if !succeeded {
+		return nil, errors.Join(errs...)
+	}
+	return peerList, nil
+}
+
+// scrapeTracker asks a single tracker for the swarm statistics of infoHash.
+func scrapeTracker(ctx context.Context, trackerURL string, infoHash [20]byte) (ScrapeResult, error) {
+	tracker, err := getTracker(trackerURL)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	results, err := tracker.Scrape(ctx, infoHash)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	result, ok := results[infoHash]
+	if !ok {
+		return ScrapeResult{}, errors.New("torrent not known to tracker")
+	}
+	return result, nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
+)
+
+const (
+	// trackerInterval is the announce interval the embedded tracker asks
+	// for. Peers are forgotten after missing two announces.
+	trackerInterval    = 2 * time.Minute
+	trackerMinInterval = 30 * time.Second
+	trackerPeerTTL     = 2*trackerInterval + trackerMinInterval
+
+	defaultTrackerNumWant = 50
+	maxTrackerNumWant     = 200
+)
+
+// trackerServer is an in-memory BitTorrent tracker.
+type trackerServer struct {
+	store    *swarmStore
+	interval time.Duration
+}
+
+func newTrackerServer() *trackerServer {
+	return &trackerServer{
+		store:    newSwarmStore(trackerPeerTTL),
+		interval: trackerInterval,
+	}
+}
+
+// sweepLoop drops expired peers until ctx is done.
+func (s *trackerServer) sweepLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.store.sweep()
+		}
+	}
+}
+
+func (s *trackerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/announce":
+		s.serveAnnounce(w, r)
+	case "/scrape":
+		s.serveScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type httpTrackerFailure struct {
+	FailureReason string `bencode:"failure reason"`
+}
+
+type httpTrackerAnnounce struct {
+	Interval    int64 `bencode:"interval"`
+	MinInterval int64 `bencode:"min interval"`
+	Complete    int   `bencode:"complete"`
+	Incomplete  int   `bencode:"incomplete"`
+
+	// Peers holds a compact string or a list of peerDict.
+	Peers  any    `bencode:"peers"`
+	Peers6 []byte `bencode:"peers6,omitempty"`
+}
+
+type httpTrackerScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+type httpTrackerScrape struct {
+	Files map[string]httpTrackerScrapeFile `bencode:"files"`
+}
+
+// writeBencode sends v as the response body.
+func writeBencode(w http.ResponseWriter, v any) {
+	body, err := bencode.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(body)
+}
+
+// writeTrackerFailure reports a failure the way clients expect it: as a
+// bencoded failure reason with status 200.
+func writeTrackerFailure(w http.ResponseWriter, reason string) {
+	writeBencode(w, httpTrackerFailure{FailureReason: reason})
+}
+
+func queryHash(value string) ([20]byte, bool) {
+	if len(value) != 20 {
+		return [20]byte{}, false
+	}
+	return [20]byte([]byte(value)), true
+}
+
+func queryInt(query map[string][]string, key string) (int64, error) {
+	values := query[key]
+	if len(values) == 0 {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid " + key)
+	}
+	return n, nil
+}
+
+// parseTrackerEvent is the inverse of AnnounceEvent.String.
+func parseTrackerEvent(s string) (AnnounceEvent, error) {
+	switch s {
+	case "":
+		return EventNone, nil
+	case "started":
+		return EventStarted, nil
+	case "completed":
+		return EventCompleted, nil
+	case "stopped":
+		return EventStopped, nil
+	}
+	return EventNone, errors.New("invalid event")
+}
+
+// announceAddr returns the address to list a peer under: the connection's
+// source address, or the ip parameter if trustsClaimedIP allows it.
+func announceAddr(r *http.Request, port uint16) (netip.AddrPort, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	source, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	source = source.Unmap()
+	if ip, err := netip.ParseAddr(r.URL.Query().Get("ip")); err == nil && trustsClaimedIP(source) {
+		return netip.AddrPortFrom(ip.Unmap(), port), nil
+	}
+	return netip.AddrPortFrom(source, port), nil
+}
+
+// trustsClaimedIP reports whether a peer announcing from source may list
+// itself under another address. Only peers on the local machine or network
+// may, e.g. behind the same NAT as the tracker; otherwise anyone could add
+// third parties to a swarm.
+func trustsClaimedIP(source netip.Addr) bool {
+	return source.IsLoopback() || source.IsPrivate()
+}
+
+func (s *trackerServer) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	infoHash, ok := queryHash(query.Get("info_hash"))
+	if !ok {
+		writeTrackerFailure(w, "invalid info_hash")
+		return
+	}
+	peerID, ok := queryHash(query.Get("peer_id"))
+	if !ok {
+		writeTrackerFailure(w, "invalid peer_id")
+		return
+	}
+	port, err := strconv.ParseUint(query.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		writeTrackerFailure(w, "invalid port")
+		return
+	}
+	left, err := queryInt(query, "left")
+	if err != nil {
+		writeTrackerFailure(w, err.Error())
+		return
+	}
+	numWant, err := queryInt(query, "numwant")
+	if err != nil {
+		writeTrackerFailure(w, err.Error())
+		return
+	}
+	if _, ok := query["numwant"]; !ok {
+		numWant = defaultTrackerNumWant
+	}
+	numWant = min(numWant, maxTrackerNumWant)
+	event, err := parseTrackerEvent(query.Get("event"))
+	if err != nil {
+		writeTrackerFailure(w, err.Error())
+		return
+	}
+	addr, err := announceAddr(r, uint16(port))
+	if err != nil {
+		writeTrackerFailure(w, "cannot determine peer address")
+		return
+	}
+
+	peers, complete, incomplete := s.store.announce(infoHash, swarmPeer{
+		ID:   peerID,
+		Addr: addr,
+		Left: left,
+	}, event, int(numWant))
+
+	res := httpTrackerAnnounce{
+		Interval:    int64(s.interval / time.Second),
+		MinInterval: int64(trackerMinInterval / time.Second),
+		Complete:    complete,
+		Incomplete:  incomplete,
+	}
+	if query.Get("compact") != "0" {
+		var peers4 []byte
+		for _, p := range peers {
+			if p.Addr.Addr().Is4() {
+				peers4 = appendCompactPeer(peers4, p.Addr)
+			} else {
+				res.Peers6 = appendCompactPeer(res.Peers6, p.Addr)
+			}
+		}
+		res.Peers = peers4
+		if peers4 == nil {
+			res.Peers = []byte{}
+		}
+	} else {
+		noPeerID := query.Get("no_peer_id") == "1"
+		dicts := []peerDict{}
+		for _, p := range peers {
+			d := peerDict{IP: p.Addr.Addr().String(), Port: p.Addr.Port()}
+			if !noPeerID {
+				d.PeerID = p.ID[:]
+			}
+			dicts = append(dicts, d)
+		}
+		res.Peers = dicts
+	}
+	writeBencode(w, res)
+}
+
+func (s *trackerServer) serveScrape(w http.ResponseWriter, r *http.Request) {
+	var infoHashes [][20]byte
+	for _, value := range r.URL.Query()["info_hash"] {
+		h, ok := queryHash(value)
+		if !ok {
+			writeTrackerFailure(w, "invalid info_hash")
+			return
+		}
+		infoHashes = append(infoHashes, h)
+	}
+	res := httpTrackerScrape{Files: map[string]httpTrackerScrapeFile{}}
+	for h, stats := range s.store.scrape(infoHashes) {
+		res.Files[string(h[:])] = httpTrackerScrapeFile(stats)
+	}
+	writeBencode(w, res)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// swarmPeer is a peer as the embedded tracker knows it.
+type swarmPeer struct {
+	ID      [20]byte
+	Addr    netip.AddrPort
+	Left    int64
+	expires time.Time
+}
+
+type swarm struct {
+	peers      map[netip.AddrPort]*swarmPeer
+	downloaded int
+}
+
+// swarmStore keeps the peers of every torrent the embedded tracker has
+// seen. A peer that does not re-announce within ttl is dropped.
+type swarmStore struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	swarms map[[20]byte]*swarm
+}
+
+func newSwarmStore(ttl time.Duration) *swarmStore {
+	return &swarmStore{ttl: ttl, swarms: map[[20]byte]*swarm{}}
+}
+
+// announce records an announce from peer and returns up to numWant other
+// peers in random order, along with the swarm's seeder and leecher counts.
+func (s *swarmStore) announce(infoHash [20]byte, peer swarmPeer, event AnnounceEvent, numWant int) (peers []swarmPeer, complete, incomplete int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	sw := s.swarms[infoHash]
+	if sw == nil {
+		if event == EventStopped {
+			return nil, 0, 0
+		}
+		sw = &swarm{peers: map[netip.AddrPort]*swarmPeer{}}
+		s.swarms[infoHash] = sw
+	}
+	sw.expire(now)
+
+	if event == EventStopped {
+		delete(sw.peers, peer.Addr)
+	} else {
+		if event == EventCompleted {
+			if prev, ok := sw.peers[peer.Addr]; !ok || prev.Left != 0 {
+				sw.downloaded++
+			}
+		}
+		peer.expires = now.Add(s.ttl)
+		sw.peers[peer.Addr] = &peer
+	}
+
+	for addr, p := range sw.peers {
+		if p.Left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+		if addr != peer.Addr {
+			peers = append(peers, *p)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > numWant {
+		peers = peers[:numWant]
+	}
+	return peers, complete, incomplete
+}
+
+// scrape returns the statistics of the torrents in infoHashes, or of every
+// torrent when infoHashes is empty. Unknown torrents are left out.
+func (s *swarmStore) scrape(infoHashes [][20]byte) map[[20]byte]ScrapeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if len(infoHashes) == 0 {
+		for h := range s.swarms {
+			infoHashes = append(infoHashes, h)
+		}
+	}
+	results := make(map[[20]byte]ScrapeResult, len(infoHashes))
+	for _, h := range infoHashes {
+		sw := s.swarms[h]
+		if sw == nil {
+			continue
+		}
+		sw.expire(now)
+		results[h] = sw.stats()
+	}
+	return results
+}
+
+// sweep drops expired peers, and torrents left with no peers and no
+// completed downloads.
+func (s *swarmStore) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for h, sw := range s.swarms {
+		sw.expire(now)
+		if len(sw.peers) == 0 && sw.downloaded == 0 {
+			delete(s.swarms, h)
+		}
+	}
+}
+
+func (sw *swarm) expire(now time.Time) {
+	for addr, p := range sw.peers {
+		if now.After(p.expires) {
+			delete(sw.peers, addr)
+		}
+	}
+}
+
+func (sw *swarm) stats() ScrapeResult {
+	res := ScrapeResult{Downloaded: sw.downloaded}
+	for _, p := range sw.peers {
+		if p.Left == 0 {
+			res.Complete++
+		} else {
+			res.Incomplete++
+		}
+	}
+	return res
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startUDPTracker serves a tracker over UDP on a loopback port until the
+// test ends. Packets pass through conn, which lets tests interfere.
+func startUDPTracker(t *testing.T, wrap func(net.PacketConn) net.PacketConn) *udpTracker {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn := pc
+		if wrap != nil {
+			conn = wrap(pc)
+		}
+		newTrackerServer().serveUDP(ctx, conn)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	tracker, err := newUDPTracker("udp://" + pc.LocalAddr().String() + "/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.BaseTimeout = 50 * time.Millisecond
+	tracker.MaxRetries = 3
+	return tracker
+}
+
+// testSwarm announces a seeder and then a leecher, and checks that the
+// leecher is told about the seeder.
+func testSwarm(t *testing.T, tracker Tracker) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	infoHash := [20]byte{1, 2, 3}
+	seeder := AnnounceRequest{
+		InfoHash: infoHash,
+		PeerID:   [20]byte{'s'},
+		Port:     7001,
+		Left:     0,
+		Event:    EventStarted,
+	}
+	if _, err := tracker.Announce(ctx, seeder); err != nil {
+		t.Fatalf("seeder announce: %v", err)
+	}
+	leecher := AnnounceRequest{
+		InfoHash: infoHash,
+		PeerID:   [20]byte{'l'},
+		Port:     7002,
+		Left:     1000,
+		Event:    EventStarted,
+	}
+	res, err := tracker.Announce(ctx, leecher)
+	if err != nil {
+		t.Fatalf("leecher announce: %v", err)
+	}
+	if res.Complete != 1 || res.Incomplete != 1 {
+		t.Errorf("announce counts = %d seeders, %d leechers, want 1 and 1", res.Complete, res.Incomplete)
+	}
+	if res.Interval <= 0 {
+		t.Errorf("announce interval = %v", res.Interval)
+	}
+	want := netip.MustParseAddrPort("127.0.0.1:7001")
+	if len(res.Peers) != 1 || res.Peers[0].Addr != want {
+		t.Errorf("announce peers = %v, want only %v", res.Peers, want)
+	}
+
+	leecher.Event = EventCompleted
+	leecher.Left = 0
+	if _, err := tracker.Announce(ctx, leecher); err != nil {
+		t.Fatalf("completed announce: %v", err)
+	}
+	other := [20]byte{9}
+	scrape, err := tracker.Scrape(ctx, infoHash, other)
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	if got := scrape[infoHash]; got != (ScrapeResult{Complete: 2, Downloaded: 1}) {
+		t.Errorf("scrape = %+v, want 2 seeders and 1 download", got)
+	}
+	if got := scrape[other]; got != (ScrapeResult{}) {
+		t.Errorf("scrape of unknown torrent = %+v, want zeros", got)
+	}
+
+	seeder.Event = EventStopped
+	if _, err := tracker.Announce(ctx, seeder); err != nil {
+		t.Fatalf("stopped announce: %v", err)
+	}
+	scrape, err = tracker.Scrape(ctx, infoHash)
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	if got := scrape[infoHash].Complete; got != 1 {
+		t.Errorf("seeders after stopped = %d, want 1", got)
+	}
+}
+
+func TestUDPTrackerRoundTrip(t *testing.T) {
+	testSwarm(t, startUDPTracker(t, nil))
+}
+
+// lossyConn drops the first request it reads, so the client has to
+// retransmit.
+type lossyConn struct {
+	net.PacketConn
+	once sync.Once
+}
+
+func (c *lossyConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		dropped := false
+		c.once.Do(func() { dropped = err == nil })
+		if !dropped {
+			return n, addr, err
+		}
+	}
+}
+
+func TestUDPTrackerRetransmits(t *testing.T) {
+	tracker := startUDPTracker(t, func(pc net.PacketConn) net.PacketConn {
+		return &lossyConn{PacketConn: pc}
+	})
+	testSwarm(t, tracker)
+}
+
+// countingConn counts the requests it reads by action.
+type countingConn struct {
+	net.PacketConn
+	mu      sync.Mutex
+	actions map[uint32]int
+}
+
+func (c *countingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil && n >= 16 {
+		c.mu.Lock()
+		c.actions[binary.BigEndian.Uint32(p[8:12])]++
+		c.mu.Unlock()
+	}
+	return n, addr, err
+}
+
+func (c *countingConn) count(action uint32) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.actions[action]
+}
+
+// Transactions share a socket, so the connection ID stays valid.
+func TestUDPTrackerReusesConnectionID(t *testing.T) {
+	counter := make(chan *countingConn, 1)
+	tracker := startUDPTracker(t, func(pc net.PacketConn) net.PacketConn {
+		c := &countingConn{PacketConn: pc, actions: map[uint32]int{}}
+		counter <- c
+		return c
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for range 3 {
+		if _, err := tracker.Announce(ctx, AnnounceRequest{InfoHash: [20]byte{1}, Port: 7001}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tracker.Scrape(ctx, [20]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	c := <-counter
+	if got := c.count(udpActionConnect); got != 1 {
+		t.Errorf("%d connects, want 1", got)
+	}
+	if got := c.count(udpActionAnnounce); got != 3 {
+		t.Errorf("%d announces, want 3", got)
+	}
+}
+
+// A response with more peers than fit in a small buffer arrives whole.
+func TestUDPTrackerLargeResponse(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	const numPeers = 1000
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 16 {
+				continue
+			}
+			res := make([]byte, 8, 20+6*numPeers)
+			copy(res, buf[8:16]) // action and transaction ID
+			switch binary.BigEndian.Uint32(buf[8:12]) {
+			case udpActionConnect:
+				res = binary.BigEndian.AppendUint64(res, 42)
+			case udpActionAnnounce:
+				res = append(res, make([]byte, 12)...)
+				for i := range numPeers {
+					res = appendCompactPeer(res, netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 7000))
+				}
+			}
+			pc.WriteTo(res, from)
+		}
+	}()
+
+	tracker, err := newUDPTracker("udp://" + pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.BaseTimeout = time.Second
+	tracker.MaxRetries = 1
+	res, err := tracker.Announce(context.Background(), AnnounceRequest{Port: 7001, NumWant: numPeers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Peers) != numPeers {
+		t.Errorf("got %d peers, want %d", len(res.Peers), numPeers)
+	}
+}
+
+func TestUDPTrackerTimeout(t *testing.T) {
+	// nothing listens on this port once it is closed
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	tracker, err := newUDPTracker("udp://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.BaseTimeout = 10 * time.Millisecond
+	tracker.MaxRetries = 1
+	_, err = tracker.Announce(context.Background(), AnnounceRequest{Port: 7001})
+	if err == nil {
+		t.Fatal("announce to a dead tracker succeeded")
+	}
+}
+
+func TestHTTPTrackerRoundTrip(t *testing.T) {
+	server := httptest.NewServer(newTrackerServer())
+	defer server.Close()
+	testSwarm(t, newHTTPTracker(server.URL+"/announce"))
+}
+
+func TestHTTPTrackerFailure(t *testing.T) {
+	server := httptest.NewServer(newTrackerServer())
+	defer server.Close()
+	// port 0 is refused with a failure reason
+	_, err := newHTTPTracker(server.URL+"/announce").Announce(context.Background(), AnnounceRequest{})
+	if _, ok := err.(*TrackerError); !ok {
+		t.Fatalf("announce error = %v (%T), want a *TrackerError", err, err)
+	}
+}
+
+func TestTrustsClaimedIP(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"192.168.0.10", true},
+		{"fd00::1", true},
+		{"8.8.8.8", false},
+		{"2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		if got := trustsClaimedIP(netip.MustParseAddr(tt.source)); got != tt.want {
+			t.Errorf("trustsClaimedIP(%s) = %v, want %v", tt.source, got, tt.want)
+		}
+	}
+}
+
+// udpRequest builds a request packet with the given header and body.
+func udpRequest(connID uint64, action, transactionID uint32, body []byte) []byte {
+	b := binary.BigEndian.AppendUint64(nil, connID)
+	b = binary.BigEndian.AppendUint32(b, action)
+	b = binary.BigEndian.AppendUint32(b, transactionID)
+	return append(b, body...)
+}
+
+func udpAnnounceBody(port uint16) []byte {
+	b := make([]byte, 82)
+	b[0] = 1                                         // info hash
+	binary.BigEndian.PutUint32(b[76:80], 0xffffffff) // numwant -1: the default
+	binary.BigEndian.PutUint16(b[80:82], port)
+	return b
+}
+
+func TestUDPTrackerServer(t *testing.T) {
+	s := newTrackerServer()
+	from := netip.MustParseAddrPort("127.0.0.1:5000")
+
+	if res := s.handleUDP(make([]byte, 15), from); res != nil {
+		t.Errorf("short packet answered with %x", res)
+	}
+	if res := s.handleUDP(udpRequest(1, udpActionConnect, 7, nil), from); res != nil {
+		t.Errorf("connect without the protocol ID answered with %x", res)
+	}
+
+	res := s.handleUDP(udpRequest(udpProtocolID, udpActionConnect, 7, nil), from)
+	if len(res) != 16 || binary.BigEndian.Uint32(res[0:4]) != udpActionConnect || binary.BigEndian.Uint32(res[4:8]) != 7 {
+		t.Fatalf("connect response = %x", res)
+	}
+	connID := binary.BigEndian.Uint64(res[8:16])
+
+	tests := []struct {
+		name   string
+		req    []byte
+		action uint32
+	}{
+		{"announce", udpRequest(connID, udpActionAnnounce, 8, udpAnnounceBody(7001)), udpActionAnnounce},
+		{"bad connection ID", udpRequest(connID+1, udpActionAnnounce, 8, udpAnnounceBody(7001)), udpActionError},
+		{"short announce", udpRequest(connID, udpActionAnnounce, 8, nil), udpActionError},
+		{"announce of port 0", udpRequest(connID, udpActionAnnounce, 8, udpAnnounceBody(0)), udpActionError},
+		{"scrape", udpRequest(connID, udpActionScrape, 8, make([]byte, 40)), udpActionScrape},
+		{"empty scrape", udpRequest(connID, udpActionScrape, 8, nil), udpActionError},
+		{"ragged scrape", udpRequest(connID, udpActionScrape, 8, make([]byte, 30)), udpActionError},
+		{"unknown action", udpRequest(connID, 9, 8, nil), udpActionError},
+	}
+	for _, tt := range tests {
+		res := s.handleUDP(tt.req, from)
+		if len(res) < 8 || binary.BigEndian.Uint32(res[0:4]) != tt.action || binary.BigEndian.Uint32(res[4:8]) != 8 {
+			t.Errorf("%s: response = %x, want action %d", tt.name, res, tt.action)
+		}
+	}
+
+	// the ID belongs to the client's IP address, whatever its port
+	announce := udpRequest(connID, udpActionAnnounce, 9, udpAnnounceBody(7001))
+	res = s.handleUDP(announce, netip.MustParseAddrPort("127.0.0.1:5001"))
+	if binary.BigEndian.Uint32(res[0:4]) != udpActionAnnounce {
+		t.Errorf("announce from another port: response = %x", res)
+	}
+	res = s.handleUDP(announce, netip.MustParseAddrPort("127.0.0.2:5000"))
+	if binary.BigEndian.Uint32(res[0:4]) != udpActionError {
+		t.Errorf("announce from another IP: response = %x", res)
+	}
+}
+
+func TestUDPConnectionIDLifetime(t *testing.T) {
+	addr := netip.MustParseAddr("127.0.0.1")
+	issued := time.Unix(600, 0)
+	id := udpConnectionID(addr, issued.Unix()/60)
+	tests := []struct {
+		after time.Duration
+		want  bool
+	}{
+		{0, true},
+		{59 * time.Second, true},
+		{119 * time.Second, true},
+		{120 * time.Second, false},
+	}
+	for _, tt := range tests {
+		if got := validUDPConnectionID(addr, id, issued.Add(tt.after)); got != tt.want {
+			t.Errorf("ID valid %v after issue = %v, want %v", tt.after, got, tt.want)
+		}
+	}
+}
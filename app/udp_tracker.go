@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// BEP 15 protocol constants.
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// udpConnectionIDLifetime is how long a client may use a connection ID.
+	udpConnectionIDLifetime = time.Minute
+
+	// BEP 41 option types.
+	udpOptionEndOfOptions = 0
+	udpOptionURLData      = 2
+)
+
+// udpTracker is a client for a single UDP tracker. It caches the connection
+// ID between transactions and retransmits with the BEP 15 back-off of
+// 15 * 2^n seconds. Every transaction goes out over the same socket, since
+// trackers may bind connection IDs to the address and port they came from;
+// a reader goroutine hands each response to the transaction it answers.
+type udpTracker struct {
+	host    string // host:port
+	urlData string // path and query sent as BEP 41 URL data
+
+	// BaseTimeout and MaxRetries control retransmission; a request is
+	// abandoned after the attempt with timeout BaseTimeout * 2^MaxRetries.
+	BaseTimeout time.Duration
+	MaxRetries  int
+
+	mu         sync.Mutex
+	connID     uint64
+	connIDTime time.Time
+	conn       *net.UDPConn // nil until the first transaction
+	addr       netip.AddrPort
+	pending    map[uint32]chan []byte // by transaction ID
+}
+
+func newUDPTracker(trackerURL string) (*udpTracker, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" {
+		return nil, fmt.Errorf("not a UDP tracker: %s", trackerURL)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("UDP tracker URL has no port: %s", trackerURL)
+	}
+	return &udpTracker{
+		host:        u.Host,
+		urlData:     u.RequestURI(),
+		BaseTimeout: 15 * time.Second,
+		MaxRetries:  8,
+		pending:     map[uint32]chan []byte{},
+	}, nil
+}
+
+var errUDPTimeout = errors.New("UDP tracker did not respond")
+
+// udpMaxDatagram is larger than any UDP payload, so a response that fills
+// the receive buffer has been cut short.
+const udpMaxDatagram = 64 << 10
+
+// socket returns the tracker's address and the socket to reach it on,
+// opening the socket and starting its reader on first use.
+func (t *udpTracker) socket(ctx context.Context) (*net.UDPConn, netip.AddrPort, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		return t.conn, t.addr, nil
+	}
+	host, port, err := net.SplitHostPort(t.host)
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	portNum, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	t.conn = conn
+	t.addr = netip.AddrPortFrom(ips[0].Unmap(), uint16(portNum))
+	// a connection ID obtained from another socket may not be accepted
+	t.connIDTime = time.Time{}
+	go t.readLoop(conn, t.addr)
+	return t.conn, t.addr, nil
+}
+
+// readLoop delivers the tracker's responses on conn to the transactions
+// waiting for them. If reading fails, the socket is dropped and the next
+// transaction opens a new one.
+func (t *udpTracker) readLoop(conn *net.UDPConn, addr netip.AddrPort) {
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			t.mu.Lock()
+			if t.conn == conn {
+				t.conn = nil
+			}
+			t.mu.Unlock()
+			conn.Close()
+			return
+		}
+		if from.Addr().Unmap() != addr.Addr() || from.Port() != addr.Port() || n < 8 {
+			continue // not from the tracker
+		}
+		transactionID := binary.BigEndian.Uint32(buf[4:8])
+		t.mu.Lock()
+		ch := t.pending[transactionID]
+		delete(t.pending, transactionID)
+		t.mu.Unlock()
+		if ch != nil {
+			ch <- append([]byte(nil), buf[:n]...)
+		}
+	}
+}
+
+// expect registers a new transaction and returns its ID and the channel
+// its response will arrive on.
+func (t *udpTracker) expect() (uint32, chan []byte) {
+	ch := make(chan []byte, 1)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		var b [4]byte
+		rand.Read(b[:])
+		transactionID := binary.BigEndian.Uint32(b[:])
+		if _, ok := t.pending[transactionID]; !ok {
+			t.pending[transactionID] = ch
+			return transactionID, ch
+		}
+	}
+}
+
+func (t *udpTracker) unexpect(transactionID uint32) {
+	t.mu.Lock()
+	delete(t.pending, transactionID)
+	t.mu.Unlock()
+}
+
+// roundTrip sends a request built by build, which is given the current
+// transaction ID, and waits for the matching response of the given action.
+// It resends on every timeout until MaxRetries is exhausted. The tracker's
+// address is returned with the response.
+func (t *udpTracker) roundTrip(ctx context.Context, action uint32, build func(transactionID uint32) []byte) ([]byte, netip.AddrPort, error) {
+	for n := 0; n <= t.MaxRetries; n++ {
+		conn, addr, err := t.socket(ctx)
+		if err != nil {
+			return nil, netip.AddrPort{}, err
+		}
+		transactionID, responses := t.expect()
+		if _, err := conn.WriteToUDPAddrPort(build(transactionID), addr); err != nil {
+			t.unexpect(transactionID)
+			return nil, netip.AddrPort{}, err
+		}
+
+		timer := time.NewTimer(t.BaseTimeout << n)
+		var res []byte
+		select {
+		case res = <-responses:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		t.unexpect(transactionID)
+		if res == nil {
+			if err := ctx.Err(); err != nil {
+				return nil, netip.AddrPort{}, err
+			}
+			continue
+		}
+
+		if len(res) == udpMaxDatagram {
+			return nil, netip.AddrPort{}, fmt.Errorf("tracker response fills the %d-byte receive buffer", udpMaxDatagram)
+		}
+		switch binary.BigEndian.Uint32(res[0:4]) {
+		case action:
+			return res, addr, nil
+		case udpActionError:
+			return nil, netip.AddrPort{}, &TrackerError{Reason: string(res[8:])}
+		}
+		return nil, netip.AddrPort{}, fmt.Errorf("unexpected action %d in tracker response", binary.BigEndian.Uint32(res[0:4]))
+	}
+	return nil, netip.AddrPort{}, errUDPTimeout
+}
+
+// connectionID returns a valid connection ID, running a connect
+// transaction if the cached one is missing or expired.
+func (t *udpTracker) connectionID(ctx context.Context) (uint64, error) {
+	t.mu.Lock()
+	if t.conn != nil && t.connIDTime.Add(udpConnectionIDLifetime).After(time.Now()) {
+		id := t.connID
+		t.mu.Unlock()
+		return id, nil
+	}
+	t.mu.Unlock()
+
+	res, _, err := t.roundTrip(ctx, udpActionConnect, func(transactionID uint32) []byte {
+		req := make([]byte, 16)
+		binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+		binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+		binary.BigEndian.PutUint32(req[12:16], transactionID)
+		return req
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(res) < 16 {
+		return 0, fmt.Errorf("connect response too short: %d bytes", len(res))
+	}
+	id := binary.BigEndian.Uint64(res[8:16])
+
+	t.mu.Lock()
+	t.connID, t.connIDTime = id, time.Now()
+	t.mu.Unlock()
+	return id, nil
+}
+
+func (t *udpTracker) forgetConnectionID() {
+	t.mu.Lock()
+	t.connIDTime = time.Time{}
+	t.mu.Unlock()
+}
+
+// transact runs a request that needs a connection ID, reconnecting once if
+// the tracker rejects the cached ID.
+func (t *udpTracker) transact(ctx context.Context, action uint32, build func(connID uint64, transactionID uint32) []byte) ([]byte, netip.AddrPort, error) {
+	for attempt := 0; ; attempt++ {
+		connID, err := t.connectionID(ctx)
+		if err != nil {
+			return nil, netip.AddrPort{}, err
+		}
+		res, addr, err := t.roundTrip(ctx, action, func(transactionID uint32) []byte {
+			return build(connID, transactionID)
+		})
+		var trackerErr *TrackerError
+		if errors.As(err, &trackerErr) && attempt == 0 {
+			// most likely an expired connection ID
+			t.forgetConnectionID()
+			continue
+		}
+		return res, addr, err
+	}
+}
+
+// urlDataOptions encodes the BEP 41 URL data option, split into chunks of
+// at most 255 bytes.
+func (t *udpTracker) urlDataOptions() []byte {
+	if t.urlData == "" || t.urlData == "/" {
+		return nil
+	}
+	var opts []byte
+	data := []byte(t.urlData)
+	for len(data) > 0 {
+		n := min(len(data), 255)
+		opts = append(opts, udpOptionURLData, byte(n))
+		opts = append(opts, data[:n]...)
+		data = data[n:]
+	}
+	return append(opts, udpOptionEndOfOptions)
+}
+
+// Announce sends an announce request and returns the tracker's response.
+func (t *udpTracker) Announce(ctx context.Context, req AnnounceRequest) (AnnounceResponse, error) {
+	res, addr, err := t.transact(ctx, udpActionAnnounce, func(connID uint64, transactionID uint32) []byte {
+		b := make([]byte, 98)
+		binary.BigEndian.PutUint64(b[0:8], connID)
+		binary.BigEndian.PutUint32(b[8:12], udpActionAnnounce)
+		binary.BigEndian.PutUint32(b[12:16], transactionID)
+		copy(b[16:36], req.InfoHash[:])
+		copy(b[36:56], req.PeerID[:])
+		binary.BigEndian.PutUint64(b[56:64], uint64(req.Downloaded))
+		binary.BigEndian.PutUint64(b[64:72], uint64(req.Left))
+		binary.BigEndian.PutUint64(b[72:80], uint64(req.Uploaded))
+		binary.BigEndian.PutUint32(b[80:84], uint32(req.Event))
+		if ip := req.IP.To4(); ip != nil {
+			copy(b[84:88], ip)
+		}
+		binary.BigEndian.PutUint32(b[88:92], req.Key)
+		binary.BigEndian.PutUint32(b[92:96], uint32(req.numWant()))
+		binary.BigEndian.PutUint16(b[96:98], req.Port)
+		return append(b, t.urlDataOptions()...)
+	})
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	if len(res) < 20 {
+		return AnnounceResponse{}, fmt.Errorf("announce response too short: %d bytes", len(res))
+	}
+	// peers are IPv6 when the tracker was reached over IPv6
+	peerSize := 6
+	if addr.Addr().Is6() {
+		peerSize = 18
+	}
+	peers, err := parseCompactPeers(res[20:], peerSize)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	return AnnounceResponse{
+		Interval:   time.Duration(binary.BigEndian.Uint32(res[8:12])) * time.Second,
+		Incomplete: int(binary.BigEndian.Uint32(res[12:16])),
+		Complete:   int(binary.BigEndian.Uint32(res[16:20])),
+		Peers:      peers,
+	}, nil
+}
+
+// udpMaxScrape is the number of info hashes that fit in one scrape packet.
+const udpMaxScrape = 74
+
+// Scrape requests swarm statistics for infoHashes, splitting them over as
+// many requests as needed.
+func (t *udpTracker) Scrape(ctx context.Context, infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	results := make(map[[20]byte]ScrapeResult, len(infoHashes))
+	for len(infoHashes) > 0 {
+		batch := infoHashes[:min(len(infoHashes), udpMaxScrape)]
+		infoHashes = infoHashes[len(batch):]
+		res, err := t.scrape(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		for i, h := range batch {
+			results[h] = res[i]
+		}
+	}
+	return results, nil
+}
+
+// scrape requests swarm statistics for up to udpMaxScrape info hashes.
+func (t *udpTracker) scrape(ctx context.Context, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	if len(infoHashes) > udpMaxScrape {
+		return nil, fmt.Errorf("cannot scrape %d torrents in one UDP request", len(infoHashes))
+	}
+	res, _, err := t.transact(ctx, udpActionScrape, func(connID uint64, transactionID uint32) []byte {
+		b := make([]byte, 16, 16+20*len(infoHashes))
+		binary.BigEndian.PutUint64(b[0:8], connID)
+		binary.BigEndian.PutUint32(b[8:12], udpActionScrape)
+		binary.BigEndian.PutUint32(b[12:16], transactionID)
+		for _, h := range infoHashes {
+			b = append(b, h[:]...)
+		}
+		return b
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) < 8+12*len(infoHashes) {
+		return nil, fmt.Errorf("scrape response too short: %d bytes", len(res))
+	}
+	results := make([]ScrapeResult, len(infoHashes))
+	for i := range results {
+		b := res[8+12*i:]
+		results[i] = ScrapeResult{
+			Complete:   int(binary.BigEndian.Uint32(b[0:4])),
+			Downloaded: int(binary.BigEndian.Uint32(b[4:8])),
+			Incomplete: int(binary.BigEndian.Uint32(b[8:12])),
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// udpConnectionIDSecret keys the connection IDs handed out by the
+// embedded UDP tracker.
+var udpConnectionIDSecret = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// udpConnectionID derives the connection ID for a client's IP address in
+// the given minute. IDs are never stored: a client's ID is recomputed to
+// validate it.
+func udpConnectionID(ip netip.Addr, minute int64) uint64 {
+	mac := hmac.New(sha256.New, udpConnectionIDSecret)
+	b, _ := ip.MarshalBinary()
+	mac.Write(b)
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(minute)))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// validUDPConnectionID accepts IDs issued in the current or previous
+// minute, so an ID lives at least as long as clients may use it.
+func validUDPConnectionID(ip netip.Addr, id uint64, now time.Time) bool {
+	minute := now.Unix() / 60
+	return id == udpConnectionID(ip, minute) || id == udpConnectionID(ip, minute-1)
+}
+
+// serveUDP answers BEP 15 requests on conn until ctx is done.
+func (s *trackerServer) serveUDP(ctx context.Context, conn net.PacketConn) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		addr := udpAddr.AddrPort()
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		if res := s.handleUDP(buf[:n], addr); res != nil {
+			conn.WriteTo(res, from)
+		}
+	}
+}
+
+// handleUDP returns the response to a single request packet, or nil if the
+// packet should be ignored.
+func (s *trackerServer) handleUDP(req []byte, from netip.AddrPort) []byte {
+	if len(req) < 16 {
+		return nil
+	}
+	connID := binary.BigEndian.Uint64(req[0:8])
+	action := binary.BigEndian.Uint32(req[8:12])
+	transactionID := binary.BigEndian.Uint32(req[12:16])
+	now := time.Now()
+
+	if action == udpActionConnect {
+		if connID != udpProtocolID {
+			return nil
+		}
+		res := make([]byte, 16)
+		binary.BigEndian.PutUint32(res[0:4], udpActionConnect)
+		binary.BigEndian.PutUint32(res[4:8], transactionID)
+		binary.BigEndian.PutUint64(res[8:16], udpConnectionID(from.Addr(), now.Unix()/60))
+		return res
+	}
+	if !validUDPConnectionID(from.Addr(), connID, now) {
+		return udpErrorResponse(transactionID, "invalid connection ID")
+	}
+	switch action {
+	case udpActionAnnounce:
+		return s.handleUDPAnnounce(req, from, transactionID)
+	case udpActionScrape:
+		return s.handleUDPScrape(req, transactionID)
+	}
+	return udpErrorResponse(transactionID, "unknown action")
+}
+
+func (s *trackerServer) handleUDPAnnounce(req []byte, from netip.AddrPort, transactionID uint32) []byte {
+	if len(req) < 98 {
+		return udpErrorResponse(transactionID, "announce request too short")
+	}
+	event := AnnounceEvent(binary.BigEndian.Uint32(req[80:84]))
+	if event < EventNone || event > EventStopped {
+		return udpErrorResponse(transactionID, "invalid event")
+	}
+	port := binary.BigEndian.Uint16(req[96:98])
+	if port == 0 {
+		return udpErrorResponse(transactionID, "invalid port")
+	}
+	numWant := int(int32(binary.BigEndian.Uint32(req[92:96])))
+	if numWant < 0 {
+		numWant = defaultTrackerNumWant
+	}
+	numWant = min(numWant, maxTrackerNumWant)
+	addr := netip.AddrPortFrom(from.Addr(), port)
+	if ip := [4]byte(req[84:88]); ip != [4]byte{} && from.Addr().Is4() && trustsClaimedIP(from.Addr()) {
+		addr = netip.AddrPortFrom(netip.AddrFrom4(ip), port)
+	}
+
+	peer := swarmPeer{
+		ID:   [20]byte(req[36:56]),
+		Addr: addr,
+		Left: int64(binary.BigEndian.Uint64(req[64:72])),
+	}
+	peers, complete, incomplete := s.store.announce([20]byte(req[16:36]), peer, event, numWant)
+
+	res := make([]byte, 20, 20+18*len(peers))
+	binary.BigEndian.PutUint32(res[0:4], udpActionAnnounce)
+	binary.BigEndian.PutUint32(res[4:8], transactionID)
+	binary.BigEndian.PutUint32(res[8:12], uint32(s.interval/time.Second))
+	binary.BigEndian.PutUint32(res[12:16], uint32(incomplete))
+	binary.BigEndian.PutUint32(res[16:20], uint32(complete))
+	// the response can only hold peers of the requester's address family
+	for _, p := range peers {
+		if p.Addr.Addr().Is4() == from.Addr().Is4() {
+			res = appendCompactPeer(res, p.Addr)
+		}
+	}
+	return res
+}
+
+func (s *trackerServer) handleUDPScrape(req []byte, transactionID uint32) []byte {
+	hashes := req[16:]
+	if len(hashes) == 0 || len(hashes)%20 != 0 || len(hashes)/20 > udpMaxScrape {
+		return udpErrorResponse(transactionID, "invalid scrape request")
+	}
+	var infoHashes [][20]byte
+	for i := 0; i < len(hashes); i += 20 {
+		infoHashes = append(infoHashes, [20]byte(hashes[i:i+20]))
+	}
+	stats := s.store.scrape(infoHashes)
+
+	res := make([]byte, 8, 8+12*len(infoHashes))
+	binary.BigEndian.PutUint32(res[0:4], udpActionScrape)
+	binary.BigEndian.PutUint32(res[4:8], transactionID)
+	for _, h := range infoHashes {
+		st := stats[h]
+		res = binary.BigEndian.AppendUint32(res, uint32(st.Complete))
+		res = binary.BigEndian.AppendUint32(res, uint32(st.Downloaded))
+		res = binary.BigEndian.AppendUint32(res, uint32(st.Incomplete))
+	}
+	return res
+}
+
+func udpErrorResponse(transactionID uint32, message string) []byte {
+	res := make([]byte, 8, 8+len(message))
+	binary.BigEndian.PutUint32(res[0:4], udpActionError)
+	binary.BigEndian.PutUint32(res[4:8], transactionID)
+	return append(res, message...)
+}
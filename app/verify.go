@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+var ErrHashMismatch = errors.New("hash mismatch")
+
+// checkPieces hashes the given pieces of data on all CPUs. The result for
+// each is nil if it matches the torrent, ErrHashMismatch if it does not, or
+// the error reading it.
+func checkPieces(info *Info, data io.ReaderAt, indexes []int) []error {
+	results := make([]error, len(indexes))
+	positions := make(chan int)
+	var wg sync.WaitGroup
+	for range min(runtime.NumCPU(), max(len(indexes), 1)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, info.PieceSize(0))
+			for pos := range positions {
+				i := indexes[pos]
+				piece := buf[:info.PieceSize(i)]
+				if _, err := data.ReadAt(piece, int64(i)*info.PieceLength); err != nil {
+					results[pos] = fmt.Errorf("reading piece: %w", err)
+				} else if !checkIntegrity(piece, i, info) {
+					results[pos] = ErrHashMismatch
+				}
+			}
+		}()
+	}
+	for pos := range indexes {
+		positions <- pos
+	}
+	close(positions)
+	wg.Wait()
+	return results
+}
+
+// allPieces returns the index of every piece of the torrent.
+func allPieces(info *Info) []int {
+	indexes := make([]int, info.NumPieces())
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return indexes
+}
+
+// verifyPieces returns the pieces of data that match the torrent.
+func verifyPieces(info *Info, data io.ReaderAt) Bitfield {
+	have := newBitfield(info.NumPieces())
+	recheckPieces(info, data, have, allPieces(info))
+	return have
+}
+
+// recheckPieces hashes the given pieces of data and updates have to match.
+func recheckPieces(info *Info, data io.ReaderAt, have Bitfield, indexes []int) {
+	for pos, err := range checkPieces(info, data, indexes) {
+		if err == nil {
+			have.Set(indexes[pos])
+		} else {
+			have.Clear(indexes[pos])
+		}
+	}
+}
+
+type pieceCheck struct {
+	Index int    `json:"index"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type fileCheck struct {
+	Path      string `json:"path"`
+	Length    int64  `json:"length"`
+	OK        bool   `json:"ok"`
+	BadPieces int    `json:"bad_pieces"`
+	Pieces    int    `json:"pieces"`
+	Error     string `json:"error,omitempty"`
+}
+
+// verifyReport is the outcome of checking data on disk against a torrent.
+type verifyReport struct {
+	InfoHash     string       `json:"info_hash"`
+	OK           bool         `json:"ok"`
+	PiecesPassed int          `json:"pieces_passed"`
+	FilesPassed  int          `json:"files_passed"`
+	Pieces       []pieceCheck `json:"pieces"`
+	Files        []fileCheck  `json:"files"`
+}
+
+// verifyData checks the torrent's files under path. A file passes if it
+// has the right size and every piece overlapping it passes.
+func verifyData(meta *Metainfo, path string) *verifyReport {
+	info := meta.Info
+	layout := newFileLayout(path, info)
+	layout.readOnly = true
+	defer layout.Close()
+
+	report := &verifyReport{InfoHash: fmt.Sprintf("%x", meta.InfoHash)}
+	for i, err := range checkPieces(info, layout, allPieces(info)) {
+		check := pieceCheck{Index: i, OK: err == nil}
+		if err != nil {
+			check.Error = err.Error()
+		} else {
+			report.PiecesPassed++
+		}
+		report.Pieces = append(report.Pieces, check)
+	}
+
+	for _, lf := range layout.files {
+		check := fileCheck{Path: lf.path, Length: lf.length}
+		if lf.length > 0 {
+			first := int(lf.offset / info.PieceLength)
+			last := int((lf.offset + lf.length - 1) / info.PieceLength)
+			check.Pieces = last - first + 1
+			for _, piece := range report.Pieces[first : last+1] {
+				if !piece.OK {
+					check.BadPieces++
+				}
+			}
+		}
+		fi, err := os.Stat(lf.path)
+		switch {
+		case err != nil:
+			check.Error = err.Error()
+		case fi.Size() != lf.length:
+			check.Error = fmt.Sprintf("size is %d bytes, want %d", fi.Size(), lf.length)
+		case check.BadPieces > 0:
+			check.Error = fmt.Sprintf("%d of %d pieces failed", check.BadPieces, check.Pieces)
+		}
+		check.OK = check.Error == ""
+		if check.OK {
+			report.FilesPassed++
+		}
+		report.Files = append(report.Files, check)
+	}
+	report.OK = report.PiecesPassed == len(report.Pieces) && report.FilesPassed == len(report.Files)
+	return report
+}
+
+func (r *verifyReport) print(w io.Writer) {
+	for _, p := range r.Pieces {
+		if p.OK {
+			fmt.Fprintf(w, "Piece %d: OK\n", p.Index)
+		} else {
+			fmt.Fprintf(w, "Piece %d: FAILED (%s)\n", p.Index, p.Error)
+		}
+	}
+	for _, f := range r.Files {
+		if f.OK {
+			fmt.Fprintf(w, "File %s: OK\n", f.Path)
+		} else {
+			fmt.Fprintf(w, "File %s: FAILED (%s)\n", f.Path, f.Error)
+		}
+	}
+	fmt.Fprintf(w, "Pieces: %d/%d passed\n", r.PiecesPassed, len(r.Pieces))
+	fmt.Fprintf(w, "Files: %d/%d passed\n", r.FilesPassed, len(r.Files))
+}
+
+func (r *verifyReport) printJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}